@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ==== Announcement channels ====
+//
+// A group with announcement_only set is read-only for its plain members:
+// only the owner and admins can post, everyone can still read and vote in
+// polls. It is set when creating the group or with
+// PATCH /api/conversations/{id} {"announcement_only": true}, and combines
+// with is_public for a broadcast channel anyone can follow.
+//
+// Such channels can have very large audiences, so their messages fan out
+// more cheaply than regular ones:
+//
+//   - no message_status row is written per member; members' read state is
+//     their last_read_seq, and read receipts are not pushed to everyone
+//   - the frame pushed over WebSocket leaves recipient_ids out rather than
+//     carrying the whole audience with every message
+//
+// Every frame is also encoded once per fan-out instead of once per
+// recipient (see Hub.sendTo).
+
+var errAnnouncementOnly = errors.New("only the owner and admins can post in this announcement channel")
+
+// checkCanPost returns errNotParticipant or errAnnouncementOnly when userID
+// may not post in convID.
+func checkCanPost(convID, userID int64) error {
+	var role string
+	var announcementOnly bool
+	err := db.QueryRow(`
+		SELECT cp.role, c.announcement_only
+		FROM conversation_participants cp
+		JOIN conversations c ON c.id = cp.conversation_id
+		WHERE cp.conversation_id = ? AND cp.user_id = ?`, convID, userID).Scan(&role, &announcementOnly)
+	if err == sql.ErrNoRows {
+		return errNotParticipant
+	}
+	if err != nil {
+		return err
+	}
+	if announcementOnly && role != roleOwner && role != roleAdmin {
+		return errAnnouncementOnly
+	}
+	return nil
+}
+
+// isAnnouncementOnly reports whether only admins can post in convID.
+func isAnnouncementOnly(convID int64) (bool, error) {
+	var announcementOnly bool
+	err := db.QueryRow("SELECT announcement_only FROM conversations WHERE id = ?", convID).Scan(&announcementOnly)
+	return announcementOnly, err
+}
+
+// recordMessageStatus writes the sent or delivered row of every participant
+// for a new message, in one statement. Announcement channels skip it.
+// Recipients of a message request never show as delivered (see contacts.go).
+func recordMessageStatus(msgID, convID int64) error {
+	_, err := db.Exec(`
+		INSERT INTO message_status (message_id, user_id, status)
+		SELECT ?, cp.user_id, IF(u.status = 'online' AND cp.message_request IS NULL, 'delivered', 'sent')
+		FROM conversation_participants cp
+		JOIN users u ON u.id = cp.user_id
+		WHERE cp.conversation_id = ?`, msgID, convID)
+	return err
+}
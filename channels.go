@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ==== Public channels ====
+//
+// A public channel is a group with is_public set. Anyone can find it in the
+// directory and join or leave it without being invited:
+//
+//	GET  /api/channels?q=&limit=&before=   the directory
+//	POST /api/conversations/{id}/join      join a public channel
+//	POST /api/conversations/{id}/leave     leave it again (membership.go)
+//
+// Channels are created with POST /api/conversations and "is_public": true,
+// optionally with a topic and description, and can start with only their
+// creator. Owners and admins switch a group between public and private with
+// PATCH /api/conversations/{id} {"is_public": ...}.
+//
+// Members read the whole history of a conversation, so someone who joins a
+// channel sees what was said before they joined; they start with nothing
+// unread.
+
+const (
+	defaultDirectoryPageSize = 20
+	maxDirectoryPageSize     = 50
+)
+
+// channelResponse is a directory entry.
+type channelResponse struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Topic       string    `json:"topic"`
+	Description string    `json:"description"`
+	MemberCount int       `json:"member_count"`
+	Joined      bool      `json:"joined"` // the caller is a member
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GET /api/channels?q=&limit=&before=
+//
+// q matches the name, topic and description. Results are newest first and
+// paginated with the ID cursor in next_cursor (pass it back as before=).
+func listChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultDirectoryPageSize
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxDirectoryPageSize {
+			limit = maxDirectoryPageSize
+		}
+	}
+	var before int64
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid before cursor")
+			return
+		}
+	}
+
+	query := `
+		SELECT c.id, COALESCE(c.name, ''), COALESCE(c.topic, ''), COALESCE(c.description, ''), c.created_at,
+		       (SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = c.id),
+		       EXISTS (SELECT 1 FROM conversation_participants WHERE conversation_id = c.id AND user_id = ?)
+		FROM conversations c`
+	args := []any{userID}
+	where := []string{"c.is_public = 1", "c.is_group = 1"}
+	if term := strings.TrimSpace(q.Get("q")); term != "" {
+		where = append(where, "(c.name LIKE ? OR c.topic LIKE ? OR c.description LIKE ?)")
+		pattern := "%" + escapeLike(term) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	if before > 0 {
+		where = append(where, "c.id < ?")
+		args = append(args, before)
+	}
+	query += " WHERE " + strings.Join(where, " AND ") + " ORDER BY c.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	channels := []channelResponse{}
+	for rows.Next() {
+		var ch channelResponse
+		if err := rows.Scan(&ch.ID, &ch.Name, &ch.Topic, &ch.Description, &ch.CreatedAt, &ch.MemberCount, &ch.Joined); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		channels = append(channels, ch)
+	}
+
+	resp := map[string]any{"channels": channels, "has_more": false, "next_cursor": nil}
+	if len(channels) > limit {
+		channels = channels[:limit]
+		resp["channels"] = channels
+		resp["has_more"] = true
+		resp["next_cursor"] = channels[limit-1].ID
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// POST /api/conversations/{id}/join
+func joinChannelHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := conversationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var isPublic bool
+	err := db.QueryRow("SELECT is_public FROM conversations WHERE id = ? AND is_group = 1", convID).Scan(&isPublic)
+	if err == sql.ErrNoRows || (err == nil && !isPublic) {
+		// private groups are not told apart from missing ones
+		httpError(w, http.StatusNotFound, "channel not found")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	added, err := addParticipant(convID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if added {
+		announceChange(convID, systemEvent{Event: systemMemberJoined, ActorID: userID})
+	}
+	respondConversation(w, convID, map[string]any{"already_member": !added})
+}
+
+// validateChannelInfo trims and checks the topic and description of a new conversation.
+func validateChannelInfo(req *createConversationRequest) error {
+	req.Topic = strings.TrimSpace(req.Topic)
+	req.Description = strings.TrimSpace(req.Description)
+	if (req.Topic != "" || req.Description != "") && !req.IsGroup {
+		return errors.New("only groups have a topic and description")
+	}
+	if utf8.RuneCountInString(req.Topic) > maxTopicLength {
+		return fmt.Errorf("topic must be at most %d characters", maxTopicLength)
+	}
+	if utf8.RuneCountInString(req.Description) > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+	return nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
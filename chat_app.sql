@@ -31,6 +31,14 @@ CREATE TABLE `conversations` (
   `id` bigint(20) NOT NULL,
   `name` varchar(100) DEFAULT NULL,
   `is_group` tinyint(1) DEFAULT 0,
+  `is_public` tinyint(1) NOT NULL DEFAULT 0,
+  `announcement_only` tinyint(1) NOT NULL DEFAULT 0,
+  `dm_key` varchar(41) DEFAULT NULL,
+  `message_ttl` int(11) DEFAULT NULL,
+  `ttl_mode` enum('sent','read') NOT NULL DEFAULT 'sent',
+  `topic` varchar(250) DEFAULT NULL,
+  `description` varchar(500) DEFAULT NULL,
+  `last_seq` bigint(20) NOT NULL DEFAULT 0,
   `created_at` timestamp NOT NULL DEFAULT current_timestamp()
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
@@ -38,11 +46,11 @@ CREATE TABLE `conversations` (
 -- Dumping data for table `conversations`
 --
 
-INSERT INTO `conversations` (`id`, `name`, `is_group`, `created_at`) VALUES
-(28, NULL, 0, '2025-10-02 13:05:51'),
-(29, 'New Group', 1, '2025-10-02 13:35:20'),
-(30, NULL, 0, '2025-10-02 16:57:06'),
-(31, NULL, 0, '2025-10-02 16:57:17');
+INSERT INTO `conversations` (`id`, `name`, `is_group`, `dm_key`, `last_seq`, `created_at`) VALUES
+(28, NULL, 0, '1:3', 12, '2025-10-02 13:05:51'),
+(29, 'New Group', 1, NULL, 9, '2025-10-02 13:35:20'),
+(30, NULL, 0, '3:6', 0, '2025-10-02 16:57:06'),
+(31, NULL, 0, '3:5', 0, '2025-10-02 16:57:17');
 
 -- --------------------------------------------------------
 
@@ -54,24 +62,104 @@ CREATE TABLE `conversation_participants` (
   `id` bigint(20) NOT NULL,
   `conversation_id` bigint(20) NOT NULL,
   `user_id` bigint(20) NOT NULL,
+  `role` enum('owner','admin','member') NOT NULL DEFAULT 'member',
   `joined_at` timestamp NOT NULL DEFAULT current_timestamp(),
-  `last_read_message_id` bigint(20) DEFAULT NULL
+  `last_read_message_id` bigint(20) DEFAULT NULL,
+  `last_read_seq` bigint(20) NOT NULL DEFAULT 0,
+  `muted_until` datetime DEFAULT NULL,
+  `archived` tinyint(1) NOT NULL DEFAULT 0,
+  `pinned_order` int(11) DEFAULT NULL,
+  `marked_unread` tinyint(1) NOT NULL DEFAULT 0,
+  `message_request` enum('pending','declined') DEFAULT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 --
 -- Dumping data for table `conversation_participants`
 --
 
-INSERT INTO `conversation_participants` (`id`, `conversation_id`, `user_id`, `joined_at`, `last_read_message_id`) VALUES
-(58, 28, 1, '2025-10-02 13:05:51', NULL),
-(59, 28, 3, '2025-10-02 13:05:51', NULL),
-(60, 29, 1, '2025-10-02 13:35:20', NULL),
-(61, 29, 3, '2025-10-02 13:35:20', NULL),
-(62, 29, 6, '2025-10-02 13:35:20', NULL),
-(63, 30, 6, '2025-10-02 16:57:06', NULL),
-(64, 30, 3, '2025-10-02 16:57:06', NULL),
-(65, 31, 5, '2025-10-02 16:57:17', NULL),
-(66, 31, 3, '2025-10-02 16:57:17', NULL);
+INSERT INTO `conversation_participants` (`id`, `conversation_id`, `user_id`, `role`, `joined_at`, `last_read_message_id`) VALUES
+(58, 28, 1, 'member', '2025-10-02 13:05:51', NULL),
+(59, 28, 3, 'member', '2025-10-02 13:05:51', NULL),
+(60, 29, 1, 'member', '2025-10-02 13:35:20', NULL),
+(61, 29, 3, 'owner', '2025-10-02 13:35:20', NULL),
+(62, 29, 6, 'member', '2025-10-02 13:35:20', NULL),
+(63, 30, 6, 'member', '2025-10-02 16:57:06', NULL),
+(64, 30, 3, 'member', '2025-10-02 16:57:06', NULL),
+(65, 31, 5, 'member', '2025-10-02 16:57:17', NULL),
+(66, 31, 3, 'member', '2025-10-02 16:57:17', NULL);
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `bot_commands`
+--
+
+CREATE TABLE `bot_commands` (
+  `id` bigint(20) NOT NULL,
+  `name` varchar(32) NOT NULL,
+  `bot_user_id` bigint(20) NOT NULL,
+  `description` varchar(200) NOT NULL DEFAULT '',
+  `webhook_url` varchar(500) NOT NULL,
+  `secret` char(64) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `contacts`
+--
+
+CREATE TABLE `contacts` (
+  `id` bigint(20) NOT NULL,
+  `requester_id` bigint(20) NOT NULL,
+  `addressee_id` bigint(20) NOT NULL,
+  `status` enum('pending','accepted','declined') NOT NULL DEFAULT 'pending',
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `responded_at` timestamp NULL DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `deleted_messages`
+--
+
+CREATE TABLE `deleted_messages` (
+  `message_id` bigint(20) NOT NULL,
+  `conversation_id` bigint(20) NOT NULL,
+  `seq` bigint(20) NOT NULL,
+  `deleted_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `folders`
+--
+
+CREATE TABLE `folders` (
+  `id` bigint(20) NOT NULL,
+  `user_id` bigint(20) NOT NULL,
+  `name` varchar(50) NOT NULL,
+  `kind` enum('manual','rule') NOT NULL DEFAULT 'manual',
+  `rules` text DEFAULT NULL,
+  `position` int(11) NOT NULL DEFAULT 0,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `folder_conversations`
+--
+
+CREATE TABLE `folder_conversations` (
+  `id` bigint(20) NOT NULL,
+  `folder_id` bigint(20) NOT NULL,
+  `conversation_id` bigint(20) NOT NULL,
+  `added_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 -- --------------------------------------------------------
 
@@ -82,9 +170,19 @@ INSERT INTO `conversation_participants` (`id`, `conversation_id`, `user_id`, `jo
 CREATE TABLE `messages` (
   `id` bigint(20) NOT NULL,
   `conversation_id` bigint(20) NOT NULL,
+  `seq` bigint(20) NOT NULL,
   `sender_id` bigint(20) NOT NULL,
   `content` text NOT NULL,
-  `message_type` enum('text','image','video','file') DEFAULT 'text',
+  `plain_text` text DEFAULT NULL,
+  `entities` text DEFAULT NULL,
+  `message_type` enum('text','image','video','file','system','location','contact','voice','poll') DEFAULT 'text',
+  `payload` text DEFAULT NULL,
+  `mentions` text DEFAULT NULL,
+  `forwarded_from_message_id` bigint(20) DEFAULT NULL,
+  `forwarded_from_user_id` bigint(20) DEFAULT NULL,
+  `ttl` int(11) DEFAULT NULL,
+  `client_msg_id` varchar(64) DEFAULT NULL,
+  `expires_at` timestamp NULL DEFAULT NULL,
   `created_at` timestamp NOT NULL DEFAULT current_timestamp()
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
@@ -92,28 +190,43 @@ CREATE TABLE `messages` (
 -- Dumping data for table `messages`
 --
 
-INSERT INTO `messages` (`id`, `conversation_id`, `sender_id`, `content`, `message_type`, `created_at`) VALUES
-(24, 28, 3, 'hello', 'text', '2025-10-02 10:06:14'),
-(25, 28, 1, 'how are you', 'text', '2025-10-02 10:06:30'),
-(26, 28, 1, 'yow', 'text', '2025-10-02 10:12:05'),
-(27, 28, 3, 'uko aje', 'text', '2025-10-02 10:12:17'),
-(28, 28, 1, 'niko poa', 'text', '2025-10-02 10:12:29'),
-(29, 28, 3, 'uskii inafanya', 'text', '2025-10-02 10:14:45'),
-(30, 28, 1, 'walai??', 'text', '2025-10-02 10:14:54'),
-(31, 28, 3, 'yow', 'text', '2025-10-02 10:33:33'),
-(32, 28, 1, 'uko fine?', 'text', '2025-10-02 10:33:59'),
-(33, 28, 3, 'eeh', 'text', '2025-10-02 10:34:14'),
-(34, 29, 6, 'mko aje', 'text', '2025-10-02 10:35:55'),
-(35, 29, 3, 'poa sana', 'text', '2025-10-02 10:36:04'),
-(36, 29, 1, 'njwwithee', 'text', '2025-10-02 10:36:11'),
-(37, 29, 6, 'wozaa', 'text', '2025-10-02 12:30:59'),
-(38, 29, 6, 'umbwa sana', 'text', '2025-10-02 12:31:04'),
-(39, 29, 3, 'mafi', 'text', '2025-10-02 12:31:14'),
-(40, 29, 3, 'yoww', 'text', '2025-10-02 13:16:50'),
-(41, 29, 6, 'rada wwadau', 'text', '2025-10-02 13:18:13'),
-(42, 29, 1, 'fiti', 'text', '2025-10-02 13:18:33'),
-(43, 28, 1, 'nijaa', 'text', '2025-10-02 13:54:20'),
-(44, 28, 3, 'wozaa', 'text', '2025-10-02 13:54:29');
+INSERT INTO `messages` (`id`, `conversation_id`, `seq`, `sender_id`, `content`, `plain_text`, `message_type`, `created_at`) VALUES
+(24, 28, 1, 3, 'hello', 'hello', 'text', '2025-10-02 10:06:14'),
+(25, 28, 2, 1, 'how are you', 'how are you', 'text', '2025-10-02 10:06:30'),
+(26, 28, 3, 1, 'yow', 'yow', 'text', '2025-10-02 10:12:05'),
+(27, 28, 4, 3, 'uko aje', 'uko aje', 'text', '2025-10-02 10:12:17'),
+(28, 28, 5, 1, 'niko poa', 'niko poa', 'text', '2025-10-02 10:12:29'),
+(29, 28, 6, 3, 'uskii inafanya', 'uskii inafanya', 'text', '2025-10-02 10:14:45'),
+(30, 28, 7, 1, 'walai??', 'walai??', 'text', '2025-10-02 10:14:54'),
+(31, 28, 8, 3, 'yow', 'yow', 'text', '2025-10-02 10:33:33'),
+(32, 28, 9, 1, 'uko fine?', 'uko fine?', 'text', '2025-10-02 10:33:59'),
+(33, 28, 10, 3, 'eeh', 'eeh', 'text', '2025-10-02 10:34:14'),
+(34, 29, 1, 6, 'mko aje', 'mko aje', 'text', '2025-10-02 10:35:55'),
+(35, 29, 2, 3, 'poa sana', 'poa sana', 'text', '2025-10-02 10:36:04'),
+(36, 29, 3, 1, 'njwwithee', 'njwwithee', 'text', '2025-10-02 10:36:11'),
+(37, 29, 4, 6, 'wozaa', 'wozaa', 'text', '2025-10-02 12:30:59'),
+(38, 29, 5, 6, 'umbwa sana', 'umbwa sana', 'text', '2025-10-02 12:31:04'),
+(39, 29, 6, 3, 'mafi', 'mafi', 'text', '2025-10-02 12:31:14'),
+(40, 29, 7, 3, 'yoww', 'yoww', 'text', '2025-10-02 13:16:50'),
+(41, 29, 8, 6, 'rada wwadau', 'rada wwadau', 'text', '2025-10-02 13:18:13'),
+(42, 29, 9, 1, 'fiti', 'fiti', 'text', '2025-10-02 13:18:33'),
+(43, 28, 11, 1, 'nijaa', 'nijaa', 'text', '2025-10-02 13:54:20'),
+(44, 28, 12, 3, 'wozaa', 'wozaa', 'text', '2025-10-02 13:54:29');
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `message_mentions`
+--
+
+CREATE TABLE `message_mentions` (
+  `id` bigint(20) NOT NULL,
+  `message_id` bigint(20) NOT NULL,
+  `conversation_id` bigint(20) NOT NULL,
+  `user_id` bigint(20) NOT NULL,
+  `kind` enum('user','here','all') NOT NULL DEFAULT 'user',
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
 -- --------------------------------------------------------
 
@@ -188,6 +301,98 @@ INSERT INTO `message_status` (`id`, `message_id`, `user_id`, `status`, `status_a
 
 -- --------------------------------------------------------
 
+--
+-- Table structure for table `pinned_messages`
+--
+
+CREATE TABLE `pinned_messages` (
+  `id` bigint(20) NOT NULL,
+  `conversation_id` bigint(20) NOT NULL,
+  `message_id` bigint(20) NOT NULL,
+  `pinned_by` bigint(20) NOT NULL,
+  `pinned_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `poll_votes`
+--
+
+CREATE TABLE `poll_votes` (
+  `id` bigint(20) NOT NULL,
+  `message_id` bigint(20) NOT NULL,
+  `option_id` int(11) NOT NULL,
+  `user_id` bigint(20) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `polls`
+--
+
+CREATE TABLE `polls` (
+  `message_id` bigint(20) NOT NULL,
+  `conversation_id` bigint(20) NOT NULL,
+  `multiple_choice` tinyint(1) NOT NULL DEFAULT 0,
+  `anonymous` tinyint(1) NOT NULL DEFAULT 0,
+  `closes_at` timestamp NULL DEFAULT NULL,
+  `closed_at` timestamp NULL DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `scheduled_messages`
+--
+
+CREATE TABLE `scheduled_messages` (
+  `id` bigint(20) NOT NULL,
+  `conversation_id` bigint(20) NOT NULL,
+  `sender_id` bigint(20) NOT NULL,
+  `content` text NOT NULL,
+  `message_type` enum('text','image','video','file','location','contact','voice','poll') DEFAULT 'text',
+  `payload` text DEFAULT NULL,
+  `send_at` timestamp NOT NULL,
+  `status` enum('pending','sending','sent','cancelled','failed') NOT NULL DEFAULT 'pending',
+  `message_id` bigint(20) DEFAULT NULL,
+  `error` varchar(255) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  `updated_at` timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `starred_messages`
+--
+
+CREATE TABLE `starred_messages` (
+  `id` bigint(20) NOT NULL,
+  `user_id` bigint(20) NOT NULL,
+  `message_id` bigint(20) NOT NULL,
+  `note` varchar(500) DEFAULT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
+--
+-- Table structure for table `user_blocks`
+--
+
+CREATE TABLE `user_blocks` (
+  `id` bigint(20) NOT NULL,
+  `blocker_id` bigint(20) NOT NULL,
+  `blocked_id` bigint(20) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT current_timestamp()
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- --------------------------------------------------------
+
 --
 -- Table structure for table `users`
 --
@@ -195,9 +400,12 @@ INSERT INTO `message_status` (`id`, `message_id`, `user_id`, `status`, `status_a
 CREATE TABLE `users` (
   `id` bigint(20) NOT NULL,
   `username` varchar(50) NOT NULL,
+  `display_name` varchar(100) DEFAULT NULL,
   `password_hash` varchar(255) NOT NULL,
   `status` enum('online','offline') DEFAULT 'offline',
   `last_seen` timestamp NULL DEFAULT NULL,
+  `forward_attribution` tinyint(1) NOT NULL DEFAULT 1,
+  `discoverable` tinyint(1) NOT NULL DEFAULT 1,
   `created_at` timestamp NOT NULL DEFAULT current_timestamp()
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
@@ -221,23 +429,79 @@ INSERT INTO `users` (`id`, `username`, `password_hash`, `status`, `last_seen`, `
 -- Indexes for table `conversations`
 --
 ALTER TABLE `conversations`
-  ADD PRIMARY KEY (`id`);
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `idx_conversations_public` (`is_public`),
+  ADD UNIQUE KEY `uniq_conversations_dm_key` (`dm_key`);
 
 --
 -- Indexes for table `conversation_participants`
 --
 ALTER TABLE `conversation_participants`
   ADD PRIMARY KEY (`id`),
-  ADD KEY `conversation_id` (`conversation_id`),
+  ADD UNIQUE KEY `uniq_conversation_participant` (`conversation_id`,`user_id`),
   ADD KEY `user_id` (`user_id`);
 
+--
+-- Indexes for table `bot_commands`
+--
+ALTER TABLE `bot_commands`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `bot_name` (`bot_user_id`,`name`),
+  ADD KEY `name` (`name`);
+
+--
+-- Indexes for table `contacts`
+--
+ALTER TABLE `contacts`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `uniq_contact_request` (`requester_id`,`addressee_id`),
+  ADD KEY `idx_contacts_addressee` (`addressee_id`,`status`);
+
+--
+-- Indexes for table `deleted_messages`
+--
+ALTER TABLE `deleted_messages`
+  ADD PRIMARY KEY (`message_id`),
+  ADD KEY `conversation_seq` (`conversation_id`,`seq`),
+  ADD KEY `deleted_at` (`deleted_at`);
+
+--
+-- Indexes for table `folders`
+--
+ALTER TABLE `folders`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `uniq_folder_name` (`user_id`,`name`);
+
+--
+-- Indexes for table `folder_conversations`
+--
+ALTER TABLE `folder_conversations`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `uniq_folder_conversation` (`folder_id`,`conversation_id`),
+  ADD KEY `conversation_id` (`conversation_id`);
+
 --
 -- Indexes for table `messages`
 --
 ALTER TABLE `messages`
   ADD PRIMARY KEY (`id`),
   ADD KEY `conversation_id` (`conversation_id`),
-  ADD KEY `sender_id` (`sender_id`);
+  ADD UNIQUE KEY `conversation_seq` (`conversation_id`,`seq`),
+  ADD KEY `sender_id` (`sender_id`),
+  ADD KEY `forwarded_from_message_id` (`forwarded_from_message_id`),
+  ADD KEY `forwarded_from_user_id` (`forwarded_from_user_id`),
+  ADD KEY `expires_at` (`expires_at`),
+  ADD UNIQUE KEY `sender_client_msg_id` (`sender_id`,`client_msg_id`),
+  ADD FULLTEXT KEY `plain_text` (`plain_text`);
+
+--
+-- Indexes for table `message_mentions`
+--
+ALTER TABLE `message_mentions`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `message_user` (`message_id`,`user_id`),
+  ADD KEY `user_message` (`user_id`,`message_id`),
+  ADD KEY `conversation_user` (`conversation_id`,`user_id`);
 
 --
 -- Indexes for table `message_status`
@@ -247,12 +511,64 @@ ALTER TABLE `message_status`
   ADD KEY `message_id` (`message_id`),
   ADD KEY `user_id` (`user_id`);
 
+--
+-- Indexes for table `pinned_messages`
+--
+ALTER TABLE `pinned_messages`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `conversation_message` (`conversation_id`,`message_id`),
+  ADD KEY `message_id` (`message_id`),
+  ADD KEY `pinned_by` (`pinned_by`);
+
+--
+-- Indexes for table `poll_votes`
+--
+ALTER TABLE `poll_votes`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `message_user_option` (`message_id`,`user_id`,`option_id`),
+  ADD KEY `user_id` (`user_id`);
+
+--
+-- Indexes for table `polls`
+--
+ALTER TABLE `polls`
+  ADD PRIMARY KEY (`message_id`),
+  ADD KEY `conversation_id` (`conversation_id`),
+  ADD KEY `closes_at` (`closes_at`,`closed_at`);
+
+--
+-- Indexes for table `scheduled_messages`
+--
+ALTER TABLE `scheduled_messages`
+  ADD PRIMARY KEY (`id`),
+  ADD KEY `status_send_at` (`status`,`send_at`),
+  ADD KEY `sender_id` (`sender_id`),
+  ADD KEY `conversation_id` (`conversation_id`),
+  ADD KEY `message_id` (`message_id`);
+
+--
+-- Indexes for table `starred_messages`
+--
+ALTER TABLE `starred_messages`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `user_message` (`user_id`,`message_id`),
+  ADD KEY `message_id` (`message_id`);
+
+--
+-- Indexes for table `user_blocks`
+--
+ALTER TABLE `user_blocks`
+  ADD PRIMARY KEY (`id`),
+  ADD UNIQUE KEY `uniq_user_block` (`blocker_id`,`blocked_id`),
+  ADD KEY `blocked_id` (`blocked_id`);
+
 --
 -- Indexes for table `users`
 --
 ALTER TABLE `users`
   ADD PRIMARY KEY (`id`),
-  ADD UNIQUE KEY `username` (`username`);
+  ADD UNIQUE KEY `username` (`username`),
+  ADD KEY `idx_users_display_name` (`display_name`);
 
 --
 -- AUTO_INCREMENT for dumped tables
@@ -270,18 +586,78 @@ ALTER TABLE `conversations`
 ALTER TABLE `conversation_participants`
   MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT, AUTO_INCREMENT=67;
 
+--
+-- AUTO_INCREMENT for table `bot_commands`
+--
+ALTER TABLE `bot_commands`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
+--
+-- AUTO_INCREMENT for table `contacts`
+--
+ALTER TABLE `contacts`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
+--
+-- AUTO_INCREMENT for table `folders`
+--
+ALTER TABLE `folders`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
+--
+-- AUTO_INCREMENT for table `folder_conversations`
+--
+ALTER TABLE `folder_conversations`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
 --
 -- AUTO_INCREMENT for table `messages`
 --
 ALTER TABLE `messages`
   MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT, AUTO_INCREMENT=45;
 
+--
+-- AUTO_INCREMENT for table `message_mentions`
+--
+ALTER TABLE `message_mentions`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
 --
 -- AUTO_INCREMENT for table `message_status`
 --
 ALTER TABLE `message_status`
   MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT, AUTO_INCREMENT=101;
 
+--
+-- AUTO_INCREMENT for table `pinned_messages`
+--
+ALTER TABLE `pinned_messages`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
+--
+-- AUTO_INCREMENT for table `poll_votes`
+--
+ALTER TABLE `poll_votes`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
+--
+-- AUTO_INCREMENT for table `scheduled_messages`
+--
+ALTER TABLE `scheduled_messages`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
+--
+-- AUTO_INCREMENT for table `starred_messages`
+--
+ALTER TABLE `starred_messages`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
+--
+-- AUTO_INCREMENT for table `user_blocks`
+--
+ALTER TABLE `user_blocks`
+  MODIFY `id` bigint(20) NOT NULL AUTO_INCREMENT;
+
 --
 -- AUTO_INCREMENT for table `users`
 --
@@ -299,12 +675,53 @@ ALTER TABLE `conversation_participants`
   ADD CONSTRAINT `conversation_participants_ibfk_1` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE,
   ADD CONSTRAINT `conversation_participants_ibfk_2` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
 
+--
+-- Constraints for table `bot_commands`
+--
+ALTER TABLE `bot_commands`
+  ADD CONSTRAINT `bot_commands_ibfk_1` FOREIGN KEY (`bot_user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `contacts`
+--
+ALTER TABLE `contacts`
+  ADD CONSTRAINT `contacts_ibfk_1` FOREIGN KEY (`requester_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `contacts_ibfk_2` FOREIGN KEY (`addressee_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `deleted_messages`
+--
+ALTER TABLE `deleted_messages`
+  ADD CONSTRAINT `deleted_messages_ibfk_1` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `folders`
+--
+ALTER TABLE `folders`
+  ADD CONSTRAINT `folders_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `folder_conversations`
+--
+ALTER TABLE `folder_conversations`
+  ADD CONSTRAINT `folder_conversations_ibfk_1` FOREIGN KEY (`folder_id`) REFERENCES `folders` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `folder_conversations_ibfk_2` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE;
+
 --
 -- Constraints for table `messages`
 --
 ALTER TABLE `messages`
   ADD CONSTRAINT `messages_ibfk_1` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE,
-  ADD CONSTRAINT `messages_ibfk_2` FOREIGN KEY (`sender_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+  ADD CONSTRAINT `messages_ibfk_2` FOREIGN KEY (`sender_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `messages_ibfk_3` FOREIGN KEY (`forwarded_from_user_id`) REFERENCES `users` (`id`) ON DELETE SET NULL;
+
+--
+-- Constraints for table `message_mentions`
+--
+ALTER TABLE `message_mentions`
+  ADD CONSTRAINT `message_mentions_ibfk_1` FOREIGN KEY (`message_id`) REFERENCES `messages` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `message_mentions_ibfk_2` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `message_mentions_ibfk_3` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
 
 --
 -- Constraints for table `message_status`
@@ -312,6 +729,50 @@ ALTER TABLE `messages`
 ALTER TABLE `message_status`
   ADD CONSTRAINT `message_status_ibfk_1` FOREIGN KEY (`message_id`) REFERENCES `messages` (`id`) ON DELETE CASCADE,
   ADD CONSTRAINT `message_status_ibfk_2` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `pinned_messages`
+--
+ALTER TABLE `pinned_messages`
+  ADD CONSTRAINT `pinned_messages_ibfk_1` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `pinned_messages_ibfk_2` FOREIGN KEY (`message_id`) REFERENCES `messages` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `pinned_messages_ibfk_3` FOREIGN KEY (`pinned_by`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `poll_votes`
+--
+ALTER TABLE `poll_votes`
+  ADD CONSTRAINT `poll_votes_ibfk_1` FOREIGN KEY (`message_id`) REFERENCES `polls` (`message_id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `poll_votes_ibfk_2` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `polls`
+--
+ALTER TABLE `polls`
+  ADD CONSTRAINT `polls_ibfk_1` FOREIGN KEY (`message_id`) REFERENCES `messages` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `polls_ibfk_2` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `scheduled_messages`
+--
+ALTER TABLE `scheduled_messages`
+  ADD CONSTRAINT `scheduled_messages_ibfk_1` FOREIGN KEY (`conversation_id`) REFERENCES `conversations` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `scheduled_messages_ibfk_2` FOREIGN KEY (`sender_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `scheduled_messages_ibfk_3` FOREIGN KEY (`message_id`) REFERENCES `messages` (`id`) ON DELETE SET NULL;
+
+--
+-- Constraints for table `starred_messages`
+--
+ALTER TABLE `starred_messages`
+  ADD CONSTRAINT `starred_messages_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `starred_messages_ibfk_2` FOREIGN KEY (`message_id`) REFERENCES `messages` (`id`) ON DELETE CASCADE;
+
+--
+-- Constraints for table `user_blocks`
+--
+ALTER TABLE `user_blocks`
+  ADD CONSTRAINT `user_blocks_ibfk_1` FOREIGN KEY (`blocker_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  ADD CONSTRAINT `user_blocks_ibfk_2` FOREIGN KEY (`blocked_id`) REFERENCES `users` (`id`) ON DELETE CASCADE;
 COMMIT;
 
 /*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Slash commands ====
+//
+// A text message starting with /name is a command: it is run instead of being
+// saved. The built-ins are
+//
+//	/me waves                 post "alice waves" as an action
+//	/topic [text]             show or set the topic of a group
+//	/invite @bob [@carol]     add people to a group (owners and admins)
+//	/leave                    leave a group
+//	/mute [1h|8h|1d|1w|off]   mute the conversation for yourself, forever without a duration
+//	/poll "Lunch?" "Pizza" "Sushi" [multiple] [anonymous]
+//
+// Commands answer the invoker with ephemeral frames, which only go to the
+// invoker's connection and are never stored:
+//
+//	{"type":"ephemeral","conversation_id":12,"command":"topic","content":"..."}
+//
+// Over HTTP the same replies come back in the response instead.
+//
+// Any account can act as a bot and register more commands with
+// POST /api/bots/commands. A bot's commands work in the conversations the bot
+// takes part in: invoking one POSTs the command to the bot's webhook, signed
+// with HMAC-SHA256 over the body (X-Signature: sha256=<hex>), and the bot may
+// answer {"text": "..."} to post into the conversation as itself, or
+// {"text": "...", "ephemeral": true} to answer the invoker only. Each bot
+// names its commands freely; when several bots in a conversation offer the
+// same one, it is addressed as /name@bot (the bot's username). Webhooks
+// must be https, are never called on private, loopback or link-local
+// addresses and cannot redirect.
+//
+// Start a message with // to send a literal slash.
+
+const (
+	maxTopicLength         = 250
+	maxCommandDescription  = 200
+	botWebhookTimeout      = 5 * time.Second
+	maxBotReplySize        = 64 << 10
+	maxCommandNameLength   = 32
+	maxBotWebhookURLLength = 500
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// mutedForever is stored in muted_until for a mute without a duration.
+var mutedForever = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+type command struct {
+	Usage       string
+	Description string
+	Run         func(*commandContext) error
+}
+
+// builtinCommands is filled in by init, as the commands refer back to it for
+// their usage.
+var builtinCommands map[string]command
+
+func init() {
+	builtinCommands = map[string]command{
+		"me":     {"/me <action>", "Post an action in the third person", runMeCommand},
+		"topic":  {"/topic [text]", "Show or set the topic of the group", runTopicCommand},
+		"invite": {"/invite @user [@user...]", "Add people to the group", runInviteCommand},
+		"leave":  {"/leave", "Leave the group", runLeaveCommand},
+		"mute":   {"/mute [1h|8h|1d|1w|off]", "Mute this conversation for yourself", runMuteCommand},
+		"poll":   {`/poll "question" "option" "option"... [multiple] [anonymous]`, "Start a poll", runPollCommand},
+	}
+}
+
+// EphemeralEvent is a private command reply, shown to the invoker only.
+type EphemeralEvent struct {
+	Type           string `json:"type"` // "ephemeral"
+	ConversationID int64  `json:"conversation_id"`
+	Command        string `json:"command"`
+	Content        string `json:"content"`
+}
+
+// commandContext is one invocation of a command.
+type commandContext struct {
+	ConversationID int64
+	UserID         int64
+	Name           string
+	Args           string
+	ClientMsgID    string
+
+	role    string
+	isGroup bool
+	replies []string
+	posted  *Message // what the command posted as the invoker, if anything
+}
+
+// reply queues an ephemeral answer for the invoker.
+func (c *commandContext) reply(format string, a ...any) {
+	c.replies = append(c.replies, fmt.Sprintf(format, a...))
+}
+
+// post delivers a message as the invoker through the Hub.
+func (c *commandContext) post(msg Message) error {
+	msg.ConversationID, msg.SenderID, msg.ClientMsgID = c.ConversationID, c.UserID, c.ClientMsgID
+	stored, err := hub.Deliver(msg)
+	if err != nil {
+		return err
+	}
+	c.posted = &stored
+	return nil
+}
+
+// flush pushes the queued replies to the invoker as ephemeral frames.
+func (c *commandContext) flush() {
+	for _, text := range c.replies {
+		hub.Events <- Event{
+			RecipientIDs: []int64{c.UserID},
+			Payload:      EphemeralEvent{Type: "ephemeral", ConversationID: c.ConversationID, Command: c.Name, Content: text},
+		}
+	}
+	c.replies = nil
+}
+
+// parseCommand splits "/name args" off a text message; name may be addressed
+// to one bot as name@bot. A leading // is a literal slash and loses one of
+// them. Text that merely starts with a slash, like a path, is not a command.
+func parseCommand(messageType string, content *string) (name, args string, ok bool) {
+	if messageType != "" && messageType != "text" {
+		return "", "", false
+	}
+	if strings.HasPrefix(*content, "//") {
+		*content = (*content)[1:]
+		return "", "", false
+	}
+	rest, found := strings.CutPrefix(*content, "/")
+	if !found {
+		return "", "", false
+	}
+	name = rest
+	if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+		name, args = rest[:i], rest[i:]
+	}
+	name = strings.ToLower(name)
+	base, bot, addressed := strings.Cut(name, "@")
+	if !commandNamePattern.MatchString(base) || (addressed && (bot == "" || strings.ContainsAny(bot, "/@"))) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args), true
+}
+
+// runCommand executes a command and queues its replies. It returns true when
+// a bot answers later, on its own.
+func runCommand(c *commandContext) bool {
+	var err error
+	c.role, c.isGroup, err = participantRole(c.ConversationID, c.UserID)
+	if err != nil {
+		if err != errNotParticipant {
+			log.Printf("Command /%s from user %d: %v", c.Name, c.UserID, err)
+		}
+		c.reply("You are not a participant of this conversation.")
+		return false
+	}
+
+	if cmd, ok := builtinCommands[c.Name]; ok {
+		if err := cmd.Run(c); err != nil {
+			c.reply("%s", err.Error())
+		}
+		return false
+	}
+
+	name, botName, _ := strings.Cut(c.Name, "@")
+	bots, err := findBotCommands(c.ConversationID, name, botName)
+	if err != nil {
+		log.Printf("Command /%s from user %d: %v", c.Name, c.UserID, err)
+		c.reply("/%s failed, try again later.", c.Name)
+		return false
+	}
+	switch len(bots) {
+	case 0:
+		c.reply("Unknown command /%s. Start the message with // to send it as text.", c.Name)
+		return false
+	case 1:
+	default:
+		var choices []string
+		for _, b := range bots {
+			choices = append(choices, "/"+name+"@"+b.BotUsername)
+		}
+		c.reply("Several bots here have /%s, pick one: %s", name, strings.Join(choices, ", "))
+		return false
+	}
+	bot := bots[0]
+	c.Name = name
+	// the bot answers on its own copy, after the caller is done with c
+	async := *c
+	async.replies = nil
+	go callBotCommand(&async, bot)
+	return true
+}
+
+// commandResponse is what POST /api/messages returns for a command.
+type commandResponse struct {
+	Command string   `json:"command"`
+	Replies []string `json:"replies"`
+	Message *Message `json:"message,omitempty"` // posted by the command (/me, /poll)
+	Pending bool     `json:"pending"`           // a bot answers later over the WebSocket
+}
+
+// respondCommand runs a command sent through sendMessageHandler, as the
+// authenticated user.
+func respondCommand(w http.ResponseWriter, r *http.Request, req sendMessageRequest, name, args string) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if req.SendAt != nil {
+		httpError(w, http.StatusBadRequest, "slash commands cannot be scheduled; start the message with // to schedule it as text")
+		return
+	}
+	c := &commandContext{ConversationID: req.ConversationID, UserID: userID, Name: name, Args: args, ClientMsgID: req.ClientMsgID}
+	pending := runCommand(c)
+	resp := commandResponse{Command: name, Replies: append([]string{}, c.replies...), Message: c.posted, Pending: pending}
+	status := http.StatusOK
+	if pending {
+		status = http.StatusAccepted
+	}
+	respondJSON(w, status, resp)
+}
+
+// ==== Built-in commands ====
+
+func runMeCommand(c *commandContext) error {
+	if c.Args == "" {
+		return errors.New("usage: " + builtinCommands["me"].Usage)
+	}
+	action := escapeMarkdown(usernameByID(c.UserID) + " " + c.Args)
+	return c.post(Message{Content: "_" + action + "_", MessageType: "text"})
+}
+
+func runTopicCommand(c *commandContext) error {
+	if c.Args == "" {
+		var topic sql.NullString
+		if err := db.QueryRow("SELECT topic FROM conversations WHERE id = ?", c.ConversationID).Scan(&topic); err != nil {
+			return err
+		}
+		if topic.String == "" {
+			c.reply("No topic is set.")
+		} else {
+			c.reply("Topic: %s", topic.String)
+		}
+		return nil
+	}
+	if !c.isGroup {
+		return errors.New("only groups have a topic")
+	}
+	if c.role != roleOwner && c.role != roleAdmin {
+		return errors.New("only the group owner and admins can change the topic")
+	}
+	if utf8.RuneCountInString(c.Args) > maxTopicLength {
+		return fmt.Errorf("the topic can be at most %d characters", maxTopicLength)
+	}
+	if _, err := db.Exec("UPDATE conversations SET topic = ? WHERE id = ?", c.Args, c.ConversationID); err != nil {
+		return err
+	}
+	announceChange(c.ConversationID, systemEvent{Event: systemTopicChanged, ActorID: c.UserID, Topic: c.Args})
+	return nil
+}
+
+func runInviteCommand(c *commandContext) error {
+	if !c.isGroup {
+		return errors.New("you can only invite people to groups")
+	}
+	if c.role != roleOwner && c.role != roleAdmin {
+		return errors.New("only the group owner and admins can invite people")
+	}
+	fields := strings.Fields(c.Args)
+	if len(fields) == 0 {
+		return errors.New("usage: " + builtinCommands["invite"].Usage)
+	}
+
+	var ids []int64
+	names := map[int64]string{}
+	for _, name := range fields {
+		name = strings.TrimPrefix(name, "@")
+		var userID int64
+		err := db.QueryRow("SELECT id FROM users WHERE username = ?", name).Scan(&userID)
+		if err == sql.ErrNoRows {
+			c.reply("There is no user named %s.", name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ids, names[userID] = append(ids, userID), name
+	}
+	blocked, err := blockedUserIDs(c.UserID, ids)
+	if err != nil {
+		return err
+	}
+	skip := map[int64]bool{}
+	for _, id := range blocked {
+		skip[id] = true
+	}
+	var invite []int64
+	for _, id := range uniqueIDs(ids) {
+		if skip[id] {
+			c.reply("You cannot invite %s.", names[id])
+			continue
+		}
+		invite = append(invite, id)
+	}
+
+	added, err := inviteParticipants(c.ConversationID, c.UserID, invite)
+	if err != nil {
+		return err
+	}
+	isNew := map[int64]bool{}
+	for _, id := range added {
+		isNew[id] = true
+	}
+	for _, id := range invite {
+		if !isNew[id] {
+			c.reply("%s is already in this group.", names[id])
+		}
+	}
+	return nil
+}
+
+func runLeaveCommand(c *commandContext) error {
+	if !c.isGroup {
+		return errors.New("you can only leave groups")
+	}
+	if err := dropParticipant(c.ConversationID, c.UserID, c.UserID); err != nil {
+		return err
+	}
+	c.reply("You left the group.")
+	return nil
+}
+
+func runMuteCommand(c *commandContext) error {
+	arg := strings.ToLower(c.Args)
+	if arg == "off" {
+		if _, err := db.Exec("UPDATE conversation_participants SET muted_until = NULL WHERE conversation_id = ? AND user_id = ?", c.ConversationID, c.UserID); err != nil {
+			return err
+		}
+		c.reply("Unmuted.")
+		return nil
+	}
+
+	// until is computed by the database, which muted_until is compared against
+	until, d := "?", time.Duration(0)
+	var untilArg any = mutedForever
+	if arg != "" {
+		var err error
+		if d, err = parseMuteDuration(arg); err != nil {
+			return err
+		}
+		until, untilArg = "NOW() + INTERVAL ? SECOND", int64(d.Seconds())
+	}
+	if _, err := db.Exec("UPDATE conversation_participants SET muted_until = "+until+" WHERE conversation_id = ? AND user_id = ?", untilArg, c.ConversationID, c.UserID); err != nil {
+		return err
+	}
+	if d == 0 {
+		c.reply("Muted until you unmute it with /mute off.")
+	} else {
+		c.reply("Muted for %s.", humanDuration(d))
+	}
+	return nil
+}
+
+// parseMuteDuration reads "30m", "8h", "1d" or "2w".
+func parseMuteDuration(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'m': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if len(s) >= 2 {
+		if unit, ok := units[s[len(s)-1]]; ok {
+			if n, err := strconv.Atoi(s[:len(s)-1]); err == nil && n > 0 && n <= 365*24*60 {
+				if d := time.Duration(n) * unit; d <= 365*24*time.Hour {
+					return d, nil
+				}
+			}
+		}
+	}
+	return 0, errors.New("usage: " + builtinCommands["mute"].Usage + ", e.g. /mute 8h")
+}
+
+func runPollCommand(c *commandContext) error {
+	var poll pollPayload
+	var texts []string
+	for _, tok := range splitQuoted(c.Args) {
+		switch {
+		case !tok.quoted && strings.EqualFold(strings.TrimLeft(tok.text, "-"), "multiple"):
+			poll.MultipleChoice = true
+		case !tok.quoted && strings.EqualFold(strings.TrimLeft(tok.text, "-"), "anonymous"):
+			poll.Anonymous = true
+		default:
+			texts = append(texts, tok.text)
+		}
+	}
+	if len(texts) < 1+minPollOptions {
+		return errors.New("usage: " + builtinCommands["poll"].Usage)
+	}
+	poll.Question = texts[0]
+	for _, text := range texts[1:] {
+		poll.Options = append(poll.Options, pollOption{Text: text})
+	}
+
+	msg := Message{MessageType: "poll", richPayload: richPayload{Poll: &poll}}
+	if err := validateMessageBody(c.ConversationID, &msg.MessageType, &msg.Content, &msg.richPayload); err != nil {
+		return err
+	}
+	return c.post(msg)
+}
+
+type quotedToken struct {
+	text   string
+	quoted bool
+}
+
+// splitQuoted splits on whitespace, keeping "quoted strings" (straight or
+// curly quotes) together.
+func splitQuoted(s string) []quotedToken {
+	var tokens []quotedToken
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == '"' || r == '“' {
+			end := strings.IndexAny(s[size:], `"”`)
+			if end >= 0 {
+				tokens = append(tokens, quotedToken{text: strings.TrimSpace(s[size : size+end]), quoted: true})
+				_, closeSize := utf8.DecodeRuneInString(s[size+end:])
+				s = s[size+end+closeSize:]
+				continue
+			}
+		}
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end < 0 {
+			end = len(s)
+		}
+		tokens = append(tokens, quotedToken{text: s[:end]})
+		s = s[end:]
+	}
+	return tokens
+}
+
+// ==== Bot commands ====
+
+type botCommand struct {
+	Name        string    `json:"name"`
+	BotUserID   int64     `json:"bot_user_id"`
+	BotUsername string    `json:"-"`
+	Description string    `json:"description"`
+	WebhookURL  string    `json:"webhook_url"`
+	Secret      string    `json:"secret,omitempty"` // only returned on registration
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// botCommandCall is the body POSTed to a bot's webhook.
+type botCommandCall struct {
+	Command        string `json:"command"`
+	Args           string `json:"args"`
+	ConversationID int64  `json:"conversation_id"`
+	UserID         int64  `json:"user_id"`
+	Username       string `json:"username"`
+}
+
+type botCommandReply struct {
+	Text      string `json:"text"`
+	Ephemeral bool   `json:"ephemeral"`
+}
+
+var errBotAddressBlocked = errors.New("webhook address is not public")
+
+// botHTTPClient checks every address it connects to, after DNS resolution,
+// so a webhook cannot reach the server's own network.
+var botHTTPClient = &http.Client{
+	Timeout: botWebhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: botWebhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return errBotAddressBlocked
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: botWebhookTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return errors.New("webhook redirects are not followed")
+	},
+}
+
+// isPublicIP reports whether ip is a routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// validateWebhookURL accepts absolute https URLs whose host is not a
+// private, loopback or link-local address. Hostnames are checked again when
+// called, once resolved.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || len(raw) > maxBotWebhookURLLength || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return errors.New("webhook_url must be an https URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("webhook_url must point to a public address")
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return errors.New("webhook_url must point to a public address")
+	}
+	return nil
+}
+
+// findBotCommands returns the bot commands called name offered by the bots
+// in a conversation, only botName's when it is set.
+func findBotCommands(convID int64, name, botName string) ([]botCommand, error) {
+	query := `
+		SELECT bc.name, bc.bot_user_id, u.username, bc.description, bc.webhook_url, bc.secret, bc.created_at
+		FROM bot_commands bc
+		JOIN conversation_participants cp ON cp.user_id = bc.bot_user_id AND cp.conversation_id = ?
+		JOIN users u ON u.id = bc.bot_user_id
+		WHERE bc.name = ?`
+	args := []any{convID, name}
+	if botName != "" {
+		query += " AND u.username = ?"
+		args = append(args, botName)
+	}
+	rows, err := db.Query(query+" ORDER BY u.username", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bots []botCommand
+	for rows.Next() {
+		var b botCommand
+		if err := rows.Scan(&b.Name, &b.BotUserID, &b.BotUsername, &b.Description, &b.WebhookURL, &b.Secret, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		bots = append(bots, b)
+	}
+	return bots, rows.Err()
+}
+
+// callBotCommand hands an invocation to the bot and relays its answer.
+func callBotCommand(c *commandContext, bot botCommand) {
+	defer c.flush()
+
+	body, _ := json.Marshal(botCommandCall{
+		Command:        c.Name,
+		Args:           c.Args,
+		ConversationID: c.ConversationID,
+		UserID:         c.UserID,
+		Username:       usernameByID(c.UserID),
+	})
+	mac := hmac.New(sha256.New, []byte(bot.Secret))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, bot.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Bot command /%s: %v", c.Name, err)
+		c.reply("/%s is not available right now.", c.Name)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := botHTTPClient.Do(req)
+	if err != nil {
+		log.Printf("Bot command /%s: %v", c.Name, err)
+		c.reply("/%s did not answer.", c.Name)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Bot command /%s: webhook returned %s", c.Name, resp.Status)
+		c.reply("/%s failed.", c.Name)
+		return
+	}
+
+	var reply botCommandReply
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBotReplySize)).Decode(&reply); err != nil && err != io.EOF {
+		log.Printf("Bot command /%s: invalid reply: %v", c.Name, err)
+		c.reply("/%s sent an invalid reply.", c.Name)
+		return
+	}
+	text := strings.TrimSpace(reply.Text)
+	switch {
+	case text == "":
+		// nothing to say
+	case reply.Ephemeral:
+		c.reply("%s", text)
+	default:
+		msg := Message{ConversationID: c.ConversationID, SenderID: bot.BotUserID, Content: text, MessageType: "text"}
+		if _, err := hub.Deliver(msg); err != nil {
+			log.Printf("Bot command /%s: failed to post reply: %v", c.Name, err)
+		}
+	}
+}
+
+// POST /api/bots/commands {"name": "weather", "description": "...", "webhook_url": "https://..."}
+//
+// Registers a command for the calling account. The response carries the
+// secret the webhook calls are signed with; it is not shown again.
+func registerBotCommandHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req botCommand
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	req.Name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.Name), "/"))
+	if !commandNamePattern.MatchString(req.Name) {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("name must be 1 to %d lowercase letters, digits or underscores", maxCommandNameLength))
+		return
+	}
+	if _, ok := builtinCommands[req.Name]; ok {
+		httpError(w, http.StatusConflict, "/"+req.Name+" is a built-in command")
+		return
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if utf8.RuneCountInString(req.Description) > maxCommandDescription {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("description must be at most %d characters", maxCommandDescription))
+		return
+	}
+	if err := validateWebhookURL(req.WebhookURL); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		httpError(w, http.StatusInternalServerError, "failed to generate secret")
+		return
+	}
+	req.Secret, req.BotUserID = hex.EncodeToString(secret), userID
+
+	res, err := db.Exec("INSERT INTO bot_commands (name, bot_user_id, description, webhook_url, secret) VALUES (?, ?, ?, ?, ?)",
+		req.Name, userID, req.Description, req.WebhookURL, req.Secret)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			httpError(w, http.StatusConflict, "you already registered /"+req.Name)
+			return
+		}
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	id, _ := res.LastInsertId()
+	db.QueryRow("SELECT created_at FROM bot_commands WHERE id = ?", id).Scan(&req.CreatedAt)
+
+	respondJSON(w, http.StatusCreated, map[string]any{"command": req})
+}
+
+// DELETE /api/bots/commands/{name}
+func deleteBotCommandHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	name := strings.ToLower(mux.Vars(r)["name"])
+
+	res, err := db.Exec("DELETE FROM bot_commands WHERE name = ? AND bot_user_id = ?", name, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "you have no command named /"+name)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"name": name, "deleted": true})
+}
+
+type commandInfo struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+	BotUserID   int64  `json:"bot_user_id,omitempty"`
+}
+
+// GET /api/commands?conversation_id=N
+//
+// The commands available in a conversation, for autocompletion: the
+// built-ins plus those of the bots taking part in it.
+func listCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	convID, err := strconv.ParseInt(r.URL.Query().Get("conversation_id"), 10, 64)
+	if err != nil || convID <= 0 {
+		httpError(w, http.StatusBadRequest, "conversation_id required")
+		return
+	}
+	if _, _, err := participantRole(convID, userID); err != nil {
+		participantError(w, err)
+		return
+	}
+
+	commands := []commandInfo{}
+	for _, name := range []string{"me", "topic", "invite", "leave", "mute", "poll"} {
+		cmd := builtinCommands[name]
+		commands = append(commands, commandInfo{Name: name, Usage: cmd.Usage, Description: cmd.Description})
+	}
+
+	rows, err := db.Query(`
+		SELECT bc.name, bc.description, bc.bot_user_id, u.username
+		FROM bot_commands bc
+		JOIN conversation_participants cp ON cp.user_id = bc.bot_user_id AND cp.conversation_id = ?
+		JOIN users u ON u.id = bc.bot_user_id
+		ORDER BY bc.name, u.username`, convID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+	var botCommands []commandInfo
+	var botNames []string
+	offered := map[string]int{}
+	for rows.Next() {
+		var ci commandInfo
+		var botName string
+		if err := rows.Scan(&ci.Name, &ci.Description, &ci.BotUserID, &botName); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		botCommands, botNames = append(botCommands, ci), append(botNames, botName)
+		offered[ci.Name]++
+	}
+	// commands offered by several bots here are addressed to one of them
+	for i, ci := range botCommands {
+		ci.Usage = "/" + ci.Name
+		if offered[ci.Name] > 1 {
+			ci.Usage += "@" + botNames[i]
+		}
+		commands = append(commands, ci)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{"commands": commands})
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Contacts and message requests ====
+//
+//	GET    /api/contacts                                 accepted contacts
+//	GET    /api/contacts/requests                        pending requests, both ways
+//	POST   /api/contacts/requests {"user_id": 5}         ask someone to be a contact
+//	POST   /api/contacts/requests/{user_id}/accept
+//	POST   /api/contacts/requests/{user_id}/decline
+//	DELETE /api/contacts/{user_id}
+//
+// Asking someone who already asked you accepts their request. A declined
+// request keeps looking pending to whoever sent it.
+//
+// Anyone can still start a 1-on-1 conversation with anyone, but when they
+// are not contacts it lands in the other user's requests inbox
+// (GET /api/conversations?requests=true) rather than their conversation list:
+//
+//	POST /api/conversations/{id}/accept    move it to the list, and become contacts
+//	POST /api/conversations/{id}/decline   hide it for good; the sender is not told
+//
+// Messages in a declined request are still stored but no longer pushed to
+// the recipient, mentions included.
+//
+// Until then the sender gets no presence, delivery or read receipts and no
+// typing indicators from the recipient. Accepting a contact request accepts
+// any message request between the two users as well.
+//
+// Presence (status_update frames and the status in GET /api/users) is only
+// shared between contacts and between members of a DM or private group,
+// except with the sender of a message request that has not been accepted.
+// Sharing a public channel is not enough.
+
+// ContactEvent tells a user about a contact request or its acceptance.
+type ContactEvent struct {
+	Type   string `json:"type"` // "contact_request" or "contact_accepted"
+	UserID int64  `json:"user_id"`
+}
+
+type contactRequest struct {
+	UserID    int64     `json:"user_id"` // the other user
+	Username  string    `json:"username"`
+	Direction string    `json:"direction"` // "incoming" or "outgoing"
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GET /api/contacts
+func listContactsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT u.id, u.username, COALESCE(u.display_name, ''), u.status, u.last_seen, u.created_at
+		FROM contacts c
+		JOIN users u ON u.id = IF(c.requester_id = ?, c.addressee_id, c.requester_id)
+		WHERE c.status = 'accepted' AND (c.requester_id = ? OR c.addressee_id = ?)
+		ORDER BY u.username ASC`, userID, userID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	contacts := []User{}
+	for rows.Next() {
+		u := User{}
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.Status, &u.LastSeen, &u.CreatedAt); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		contacts = append(contacts, u)
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"contacts": contacts})
+}
+
+// GET /api/contacts/requests
+func listContactRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.username, IF(c.requester_id = ?, 'outgoing', 'incoming'), c.created_at
+		FROM contacts c
+		JOIN users u ON u.id = IF(c.requester_id = ?, c.addressee_id, c.requester_id)
+		WHERE (c.addressee_id = ? AND c.status = 'pending')
+		   OR (c.requester_id = ? AND c.status IN ('pending', 'declined'))
+		ORDER BY c.created_at DESC, c.id DESC`, userID, userID, userID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	requests := []contactRequest{}
+	for rows.Next() {
+		var cr contactRequest
+		if err := rows.Scan(&cr.UserID, &cr.Username, &cr.Direction, &cr.CreatedAt); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		requests = append(requests, cr)
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"requests": requests})
+}
+
+// POST /api/contacts/requests {"user_id": 5}
+func sendContactRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.UserID <= 0 {
+		httpError(w, http.StatusBadRequest, "user_id required")
+		return
+	}
+	if req.UserID == userID {
+		httpError(w, http.StatusBadRequest, "you cannot add yourself as a contact")
+		return
+	}
+	if missing, err := missingUserIDs([]int64{req.UserID}); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	} else if len(missing) > 0 {
+		httpError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if blocked, err := isBlocked(userID, req.UserID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	} else if blocked {
+		httpError(w, http.StatusForbidden, "you cannot add this user as a contact")
+		return
+	}
+
+	// Both users are locked so that when they ask each other at the same
+	// time, the second request sees the first and accepts it
+	tx, err := db.Begin()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT id FROM users WHERE id IN (?, ?) FOR UPDATE", userID, req.UserID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	// They asked first: this accepts their request
+	var theirs string
+	err = tx.QueryRow("SELECT status FROM contacts WHERE requester_id = ? AND addressee_id = ?", req.UserID, userID).Scan(&theirs)
+	if err != nil && err != sql.ErrNoRows {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if theirs != "" {
+		tx.Rollback()
+		if theirs != "accepted" {
+			if err := addContact(userID, req.UserID); err != nil {
+				httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+				return
+			}
+		}
+		respondJSON(w, http.StatusOK, map[string]any{"user_id": req.UserID, "status": "accepted"})
+		return
+	}
+
+	res, err := tx.Exec("INSERT IGNORE INTO contacts (requester_id, addressee_id) VALUES (?, ?)", userID, req.UserID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		hub.Events <- Event{RecipientIDs: []int64{req.UserID}, Payload: ContactEvent{Type: "contact_request", UserID: userID}}
+		respondJSON(w, http.StatusCreated, map[string]any{"user_id": req.UserID, "status": "pending"})
+		return
+	}
+
+	// asked before; a declined request still reads as pending
+	status, err := contactStatus(userID, req.UserID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if status == "declined" {
+		status = "pending"
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"user_id": req.UserID, "status": status})
+}
+
+// POST /api/contacts/requests/{user_id}/accept
+func acceptContactRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, otherID, ok := contactRequestParams(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := contactStatus(otherID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if status == "" || status == "accepted" {
+		httpError(w, http.StatusNotFound, "no contact request from this user")
+		return
+	}
+	if err := addContact(userID, otherID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"user_id": otherID, "status": "accepted"})
+}
+
+// POST /api/contacts/requests/{user_id}/decline
+func declineContactRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, otherID, ok := contactRequestParams(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec(`
+		UPDATE contacts SET status = 'declined', responded_at = NOW()
+		WHERE requester_id = ? AND addressee_id = ? AND status = 'pending'`, otherID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "no pending contact request from this user")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"user_id": otherID, "status": "declined"})
+}
+
+// DELETE /api/contacts/{user_id}
+func removeContactHandler(w http.ResponseWriter, r *http.Request) {
+	userID, otherID, ok := contactRequestParams(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec(`
+		DELETE FROM contacts
+		WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)`,
+		userID, otherID, otherID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "not a contact")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"user_id": otherID, "removed": true})
+}
+
+// POST /api/conversations/{id}/accept
+func acceptMessageRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := conversationRequest(w, r)
+	if !ok {
+		return
+	}
+	senderID, ok := messageRequestSender(w, convID, userID)
+	if !ok {
+		return
+	}
+
+	if err := addContact(userID, senderID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondConversation(w, convID, map[string]any{"accepted": true})
+}
+
+// POST /api/conversations/{id}/decline
+func declineMessageRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := conversationRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := messageRequestSender(w, convID, userID); !ok {
+		return
+	}
+
+	_, err := db.Exec("UPDATE conversation_participants SET message_request = 'declined' WHERE conversation_id = ? AND user_id = ?", convID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"conversation_id": convID, "declined": true})
+}
+
+// contactRequestParams reads the caller and the {user_id} path parameter.
+func contactRequestParams(w http.ResponseWriter, r *http.Request) (userID, otherID int64, ok bool) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return 0, 0, false
+	}
+	otherID, err = strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil || otherID <= 0 {
+		httpError(w, http.StatusBadRequest, "invalid user id")
+		return 0, 0, false
+	}
+	return userID, otherID, true
+}
+
+// messageRequestSender returns the other member of a 1-on-1 conversation that
+// is a message request (pending or declined) for userID.
+func messageRequestSender(w http.ResponseWriter, convID, userID int64) (int64, bool) {
+	var request sql.NullString
+	err := db.QueryRow("SELECT message_request FROM conversation_participants WHERE conversation_id = ? AND user_id = ?", convID, userID).Scan(&request)
+	if err == sql.ErrNoRows {
+		httpError(w, http.StatusForbidden, errNotParticipant.Error())
+		return 0, false
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return 0, false
+	}
+	if !request.Valid {
+		httpError(w, http.StatusNotFound, "this conversation is not a message request")
+		return 0, false
+	}
+
+	var senderID int64
+	err = db.QueryRow("SELECT user_id FROM conversation_participants WHERE conversation_id = ? AND user_id <> ? LIMIT 1", convID, userID).Scan(&senderID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return 0, false
+	}
+	return senderID, true
+}
+
+// contactStatus returns the status of the request from requesterID to
+// addresseeID, or "" if there is none.
+func contactStatus(requesterID, addresseeID int64) (string, error) {
+	var status string
+	err := db.QueryRow("SELECT status FROM contacts WHERE requester_id = ? AND addressee_id = ?", requesterID, addresseeID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// areContacts reports whether two users are contacts, whoever asked.
+func areContacts(a, b int64) (bool, error) {
+	var ok bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM contacts
+		WHERE status = 'accepted' AND ((requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)))`,
+		a, b, b, a).Scan(&ok)
+	return ok, err
+}
+
+// addContact makes userID and otherID contacts on userID's acceptance,
+// accepts any message request between them and lets each see the other's
+// presence.
+func addContact(userID, otherID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO contacts (requester_id, addressee_id, status, responded_at) VALUES (?, ?, 'accepted', NOW())
+		ON DUPLICATE KEY UPDATE status = 'accepted', responded_at = NOW()`, otherID, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE contacts SET status = 'accepted', responded_at = NOW() WHERE requester_id = ? AND addressee_id = ?", userID, otherID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE conversation_participants cp
+		JOIN conversations c ON c.id = cp.conversation_id
+		SET cp.message_request = NULL
+		WHERE c.dm_key = ? AND cp.message_request IS NOT NULL`, dmKey(userID, otherID))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	hub.Events <- Event{RecipientIDs: []int64{otherID}, Payload: ContactEvent{Type: "contact_accepted", UserID: userID}}
+	for _, pair := range [][2]int64{{userID, otherID}, {otherID, userID}} {
+		var status string
+		if err := db.QueryRow("SELECT status FROM users WHERE id = ?", pair[0]).Scan(&status); err != nil {
+			log.Printf("Failed to load status of user %d: %v", pair[0], err)
+			continue
+		}
+		hub.Events <- Event{RecipientIDs: []int64{pair[1]}, Payload: StatusUpdate{Type: "status_update", UserID: pair[0], NewStatus: status}}
+	}
+	return nil
+}
+
+// hasMessageRequest reports whether convID is still a message request
+// (pending or declined) for userID.
+func hasMessageRequest(convID, userID int64) (bool, error) {
+	var request sql.NullString
+	err := db.QueryRow("SELECT message_request FROM conversation_participants WHERE conversation_id = ? AND user_id = ?", convID, userID).Scan(&request)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return request.Valid, err
+}
+
+// messageRecipientIDs returns the participants new messages in convID are
+// pushed to: everyone but those who declined it as a message request.
+func messageRecipientIDs(convID int64) ([]int64, error) {
+	rows, err := db.Query("SELECT user_id FROM conversation_participants WHERE conversation_id = ? AND (message_request IS NULL OR message_request <> 'declined')", convID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var uid int64
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		ids = append(ids, uid)
+	}
+	return ids, rows.Err()
+}
+
+// presenceAudience returns the users who may see userID's presence.
+func presenceAudience(userID int64) ([]int64, error) {
+	return presencePeers(userID, "own")
+}
+
+// presenceVisibleTo returns the users whose presence viewerID may see.
+func presenceVisibleTo(viewerID int64) ([]int64, error) {
+	return presencePeers(viewerID, "other")
+}
+
+// presencePeers lists the contacts of userID and the members of the DMs and
+// private groups they share, where the side named by accepted ("own" or
+// "other") has no open message request there. Public channels do not count,
+// since anyone can join them, and neither does anyone blocked either way.
+func presencePeers(userID int64, accepted string) ([]int64, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT peers.id FROM (
+			SELECT IF(requester_id = ?, addressee_id, requester_id) AS id FROM contacts
+			WHERE status = 'accepted' AND (requester_id = ? OR addressee_id = ?)
+			UNION
+			SELECT other.user_id FROM conversation_participants own
+			JOIN conversation_participants other ON other.conversation_id = own.conversation_id
+			JOIN conversations c ON c.id = own.conversation_id
+			WHERE own.user_id = ? AND other.user_id <> own.user_id AND c.is_public = 0 AND %s.message_request IS NULL
+		) peers
+		WHERE NOT EXISTS (SELECT 1 FROM user_blocks b
+		                  WHERE (b.blocker_id = ? AND b.blocked_id = peers.id) OR (b.blocker_id = peers.id AND b.blocked_id = ?))`, accepted),
+		userID, userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// broadcastStatus pushes a presence change to whoever may see it.
+func broadcastStatus(userID int64, status string) {
+	audience, err := presenceAudience(userID)
+	if err != nil {
+		log.Printf("Failed to load presence audience of user %d: %v", userID, err)
+		return
+	}
+	if len(audience) == 0 {
+		return
+	}
+	hub.Events <- Event{
+		RecipientIDs: audience,
+		Payload:      StatusUpdate{Type: "status_update", UserID: userID, NewStatus: status},
+	}
+}
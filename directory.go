@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ==== User directory ====
+//
+//	GET    /api/users?q=&status=online|offline&limit=&cursor=
+//	PATCH  /api/users/me {"display_name": "Moses Gitau"}
+//	GET    /api/users/me/blocks
+//	PUT    /api/users/me/blocks/{user_id}
+//	DELETE /api/users/me/blocks/{user_id}
+//
+// q matches the username and the display name: prefix matches come first,
+// then matches anywhere, then fuzzy ones (the letters of q in order, with
+// anything in between), each by username. Without q, everyone is listed by
+// username. Pages are cursor-based: pass next_cursor back as cursor=.
+//
+// Users who blocked each other cannot start a 1-on-1 conversation, add each
+// other to a group or send each other contact requests.
+//
+// The directory leaves out users the caller blocked or was blocked by, and
+// users who are not discoverable (see PUT /api/users/me/privacy) unless they
+// are contacts or share a conversation with the caller. Presence follows
+// contacts.go: users whose presence the caller may not see are listed as
+// offline, and the status filter goes by what the caller sees.
+
+const (
+	defaultUserPageSize     = 50
+	maxUserPageSize         = 100
+	maxDisplayNameLength    = 100
+	minFuzzyUserQueryLength = 2
+)
+
+// GET /api/users?q=&status=&limit=&cursor=
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	viewerID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultUserPageSize
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxUserPageSize {
+			limit = maxUserPageSize
+		}
+	}
+	var afterRank int
+	var afterName string
+	if v := q.Get("cursor"); v != "" {
+		if afterRank, afterName, err = decodeUserCursor(v); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	ids, err := presenceVisibleTo(viewerID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	visible := map[int64]bool{viewerID: true}
+	for _, id := range ids {
+		visible[id] = true
+	}
+	visibleList := "?" + strings.Repeat(", ?", len(visible)-1)
+	var visibleArgs []any
+	for id := range visible {
+		visibleArgs = append(visibleArgs, id)
+	}
+
+	rank := "0"
+	var rankArgs []any
+	where := []string{
+		`NOT EXISTS (SELECT 1 FROM user_blocks b
+		             WHERE (b.blocker_id = ? AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = ?))`,
+		`(u.discoverable = 1 OR u.id = ?
+		  OR EXISTS (SELECT 1 FROM conversation_participants own
+		             JOIN conversation_participants other ON other.conversation_id = own.conversation_id
+		             WHERE own.user_id = ? AND other.user_id = u.id)
+		  OR EXISTS (SELECT 1 FROM contacts c
+		             WHERE c.status = 'accepted'
+		               AND ((c.requester_id = ? AND c.addressee_id = u.id) OR (c.requester_id = u.id AND c.addressee_id = ?))))`,
+	}
+	whereArgs := []any{viewerID, viewerID, viewerID, viewerID, viewerID, viewerID}
+
+	if term := strings.TrimSpace(q.Get("q")); term != "" {
+		prefix := escapeLike(term) + "%"
+		anywhere := "%" + escapeLike(term) + "%"
+		fuzzy := anywhere
+		if utf8.RuneCountInString(term) >= minFuzzyUserQueryLength {
+			fuzzy = fuzzyLikePattern(term)
+		}
+		rank = `CASE WHEN u.username LIKE ? OR u.display_name LIKE ? THEN 0
+		             WHEN u.username LIKE ? OR u.display_name LIKE ? THEN 1
+		             ELSE 2 END`
+		rankArgs = []any{prefix, prefix, anywhere, anywhere}
+		where = append(where, "(u.username LIKE ? OR u.display_name LIKE ?)")
+		whereArgs = append(whereArgs, fuzzy, fuzzy)
+	}
+
+	switch q.Get("status") {
+	case "":
+	case "online":
+		where = append(where, "u.status = 'online' AND u.id IN ("+visibleList+")")
+		whereArgs = append(whereArgs, visibleArgs...)
+	case "offline":
+		where = append(where, "(u.status <> 'online' OR u.id NOT IN ("+visibleList+"))")
+		whereArgs = append(whereArgs, visibleArgs...)
+	default:
+		httpError(w, http.StatusBadRequest, "status must be online or offline")
+		return
+	}
+
+	query := `
+		SELECT id, username, display_name, status, last_seen, created_at, match_rank FROM (
+			SELECT u.id, u.username, COALESCE(u.display_name, '') AS display_name, u.status, u.last_seen, u.created_at,
+			       ` + rank + ` AS match_rank
+			FROM users u
+			WHERE ` + strings.Join(where, " AND ") + `
+		) ranked`
+	args := append(append([]any{}, rankArgs...), whereArgs...)
+	if q.Get("cursor") != "" {
+		query += " WHERE (match_rank, username) > (?, ?)"
+		args = append(args, afterRank, afterName)
+	}
+	query += " ORDER BY match_rank, username LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	var ranks []int
+	for rows.Next() {
+		u := User{}
+		var matchRank int
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.Status, &u.LastSeen, &u.CreatedAt, &matchRank); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		if !visible[u.ID] {
+			u.Status, u.LastSeen = "offline", nil
+		}
+		users = append(users, u)
+		ranks = append(ranks, matchRank)
+	}
+
+	resp := map[string]any{"users": users, "has_more": false, "next_cursor": nil}
+	if len(users) > limit {
+		users = users[:limit]
+		resp["users"] = users
+		resp["has_more"] = true
+		resp["next_cursor"] = encodeUserCursor(ranks[limit-1], users[limit-1].Username)
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// PATCH /api/users/me {"display_name": "..."}
+//
+// An empty display name removes it.
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req struct {
+		DisplayName *string `json:"display_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.DisplayName == nil {
+		httpError(w, http.StatusBadRequest, "display_name required")
+		return
+	}
+	*req.DisplayName = strings.TrimSpace(*req.DisplayName)
+	if utf8.RuneCountInString(*req.DisplayName) > maxDisplayNameLength {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("display_name must be at most %d characters", maxDisplayNameLength))
+		return
+	}
+
+	displayName := sql.NullString{String: *req.DisplayName, Valid: *req.DisplayName != ""}
+	if _, err := db.Exec("UPDATE users SET display_name = ? WHERE id = ?", displayName, userID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	u := User{}
+	err = db.QueryRow("SELECT id, username, COALESCE(display_name, ''), status, last_seen, created_at FROM users WHERE id = ?", userID).
+		Scan(&u.ID, &u.Username, &u.DisplayName, &u.Status, &u.LastSeen, &u.CreatedAt)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"user": u})
+}
+
+// GET /api/users/me/blocks
+func listBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.username, COALESCE(u.display_name, ''), u.created_at
+		FROM user_blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = ?
+		ORDER BY b.created_at DESC, b.id DESC`, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	blocked := []User{}
+	for rows.Next() {
+		u := User{Status: "offline"}
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.CreatedAt); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		blocked = append(blocked, u)
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"blocked": blocked})
+}
+
+// PUT /api/users/me/blocks/{user_id}
+//
+// Blocking someone also drops any contact or contact request between you.
+func blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, otherID, ok := contactRequestParams(w, r)
+	if !ok {
+		return
+	}
+	if otherID == userID {
+		httpError(w, http.StatusBadRequest, "you cannot block yourself")
+		return
+	}
+	if missing, err := missingUserIDs([]int64{otherID}); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	} else if len(missing) > 0 {
+		httpError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	if _, err := db.Exec("INSERT IGNORE INTO user_blocks (blocker_id, blocked_id) VALUES (?, ?)", userID, otherID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	_, err := db.Exec(`
+		DELETE FROM contacts
+		WHERE (requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)`,
+		userID, otherID, otherID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"user_id": otherID, "blocked": true})
+}
+
+// DELETE /api/users/me/blocks/{user_id}
+func unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, otherID, ok := contactRequestParams(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?", userID, otherID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "user is not blocked")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"user_id": otherID, "blocked": false})
+}
+
+// isBlocked reports whether either user blocked the other.
+func isBlocked(a, b int64) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM user_blocks
+		WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?))`,
+		a, b, b, a).Scan(&blocked)
+	return blocked, err
+}
+
+// blockedUserIDs returns the users in ids who blocked userID or were
+// blocked by them.
+func blockedUserIDs(userID int64, ids []int64) ([]int64, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	in := "(?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	args := []any{userID, userID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, userID)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := db.Query(`
+		SELECT IF(blocker_id = ?, blocked_id, blocker_id) FROM user_blocks
+		WHERE (blocker_id = ? AND blocked_id IN `+in+`) OR (blocked_id = ? AND blocker_id IN `+in+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocked []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, id)
+	}
+	return blocked, rows.Err()
+}
+
+// fuzzyLikePattern matches the runes of term in order with anything in
+// between: "mgt" finds "Moses Gitau".
+func fuzzyLikePattern(term string) string {
+	var b strings.Builder
+	b.WriteString("%")
+	for _, r := range term {
+		b.WriteString(escapeLike(string(r)))
+		b.WriteString("%")
+	}
+	return b.String()
+}
+
+func encodeUserCursor(rank int, username string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(rank) + ":" + username))
+}
+
+func decodeUserCursor(cursor string) (int, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", err
+	}
+	rankStr, username, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return 0, "", fmt.Errorf("malformed cursor")
+	}
+	rank, err := strconv.Atoi(rankStr)
+	return rank, username, err
+}
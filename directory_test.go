@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestFuzzyLikePattern(t *testing.T) {
+	tests := map[string]string{
+		"":      "%",
+		"mgt":   "%m%g%t%",
+		"a_b":   `%a%\_%b%`,
+		"5%":    `%5%\%%`,
+		"é🙂":    "%é%🙂%",
+		`x\y`:   `%x%\\%y%`,
+		"moses": "%m%o%s%e%s%",
+	}
+	for in, want := range tests {
+		if got := fuzzyLikePattern(in); got != want {
+			t.Errorf("fuzzyLikePattern(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUserCursorRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		rank     int
+		username string
+	}{{0, "alice"}, {2, "Moses Gitau"}, {1, "has:colon"}, {3, ""}} {
+		rank, username, err := decodeUserCursor(encodeUserCursor(c.rank, c.username))
+		if err != nil || rank != c.rank || username != c.username {
+			t.Errorf("round trip of (%d, %q) = (%d, %q, %v)", c.rank, c.username, rank, username, err)
+		}
+	}
+}
+
+func TestDecodeUserCursorRejectsGarbage(t *testing.T) {
+	for _, cursor := range []string{"!!!", "bm9jb2xvbg", "eDphbGljZQ"} { // bad base64, "nocolon", "x:alice"
+		if _, _, err := decodeUserCursor(cursor); err == nil {
+			t.Errorf("decodeUserCursor(%q) succeeded, want an error", cursor)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Disappearing messages ====
+//
+// A conversation can carry a message TTL (conversations.message_ttl, seconds)
+// counted either from when a message is sent or from when it is first read by
+// someone other than the sender (ttl_mode). Each message copies the TTL at
+// save time, so changing the setting only affects new messages, and gets an
+// expires_at once its clock starts. System messages never expire. In a group
+// only the owner and admins can change the TTL; in a 1-on-1 either side can.
+//
+// runReaper deletes expired messages with their message_status rows (pins,
+// stars and mentions cascade) and pushes message_expired to the participants.
+// Deletions are remembered in deleted_messages for clients that were offline
+// (see sync.go).
+// Media is referenced by URL in content, so there are no attachment rows left
+// behind.
+// Until the reaper gets to them, expired messages are filtered out of every
+// read path with notExpired.
+
+const (
+	reaperInterval  = 5 * time.Second
+	reaperBatchSize = 200
+	minMessageTTL   = 5 * time.Second
+	maxMessageTTL   = 365 * 24 * time.Hour
+)
+
+// notExpired is appended to queries over messages aliased as m.
+const notExpired = "(m.expires_at IS NULL OR m.expires_at > NOW())"
+
+// MessageExpiredEvent tells clients to drop messages from their timeline.
+type MessageExpiredEvent struct {
+	Type           string  `json:"type"` // "message_expired"
+	ConversationID int64   `json:"conversation_id"`
+	MessageIDs     []int64 `json:"message_ids"`
+}
+
+// applyMessageTTL copies the conversation TTL onto a freshly saved message and,
+// in 'sent' mode, starts its clock. It returns the expiry if one was set.
+func applyMessageTTL(msgID int64) (*time.Time, error) {
+	res, err := db.Exec(`
+		UPDATE messages m
+		JOIN conversations c ON c.id = m.conversation_id
+		SET m.ttl = c.message_ttl,
+		    m.expires_at = IF(c.ttl_mode = 'sent', m.created_at + INTERVAL c.message_ttl SECOND, NULL)
+		WHERE m.id = ? AND c.message_ttl IS NOT NULL AND m.message_type <> 'system'`, msgID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+
+	var expiresAt *time.Time
+	err = db.QueryRow("SELECT expires_at FROM messages WHERE id = ?", msgID).Scan(&expiresAt)
+	return expiresAt, err
+}
+
+// startReadTTL starts the clock of read-mode messages up to lastReadSeq that
+// the reader did not send themselves.
+func startReadTTL(convID, readerID, lastReadSeq int64) error {
+	_, err := db.Exec(`
+		UPDATE messages
+		SET expires_at = NOW() + INTERVAL ttl SECOND
+		WHERE conversation_id = ? AND seq <= ? AND sender_id <> ?
+		  AND ttl IS NOT NULL AND expires_at IS NULL`, convID, lastReadSeq, readerID)
+	return err
+}
+
+// PUT /api/conversations/{id}/ttl {"ttl_seconds": 86400, "mode": "sent"}
+// ttl_seconds 0 turns disappearing messages off. Any participant may change it.
+func updateConversationTTLHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	convID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	var req struct {
+		TTLSeconds int64  `json:"ttl_seconds"`
+		Mode       string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "sent"
+	}
+	if req.Mode != "sent" && req.Mode != "read" {
+		httpError(w, http.StatusBadRequest, "mode must be sent or read")
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if req.TTLSeconds != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("ttl_seconds must be 0 or between %d and %d",
+			int64(minMessageTTL.Seconds()), int64(maxMessageTTL.Seconds())))
+		return
+	}
+
+	role, isGroup, err := participantRole(convID, userID)
+	if err != nil {
+		participantError(w, err)
+		return
+	}
+	if isGroup && role != roleOwner && role != roleAdmin {
+		httpError(w, http.StatusForbidden, "only group admins can change disappearing messages")
+		return
+	}
+
+	var ttlValue any
+	if req.TTLSeconds > 0 {
+		ttlValue = req.TTLSeconds
+	}
+	if _, err := db.Exec("UPDATE conversations SET message_ttl = ?, ttl_mode = ? WHERE id = ?", ttlValue, req.Mode, convID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	postSystemMessage(convID, systemEvent{Event: systemTTLChanged, ActorID: userID, TTLSeconds: req.TTLSeconds, TTLMode: req.Mode})
+
+	respondJSON(w, http.StatusOK, map[string]any{"conversation_id": convID, "ttl_seconds": req.TTLSeconds, "mode": req.Mode})
+}
+
+// humanDuration renders a TTL the way people pick them: "1 day", "8 hours".
+func humanDuration(d time.Duration) string {
+	units := []struct {
+		size time.Duration
+		name string
+	}{
+		{7 * 24 * time.Hour, "week"},
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+		{time.Second, "second"},
+	}
+	for _, u := range units {
+		if d >= u.size && d%u.size == 0 {
+			n := int64(d / u.size)
+			if n == 1 {
+				return "1 " + u.name
+			}
+			return fmt.Sprintf("%d %ss", n, u.name)
+		}
+	}
+	return d.String()
+}
+
+// runReaper deletes expired messages until the process exits.
+func runReaper() {
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reapExpiredMessages()
+	}
+}
+
+func reapExpiredMessages() {
+	if _, err := db.Exec("DELETE FROM deleted_messages WHERE deleted_at < NOW() - INTERVAL ? SECOND", int64(tombstoneRetention.Seconds())); err != nil {
+		log.Printf("Reaper: failed to prune deleted_messages: %v", err)
+	}
+
+	rows, err := db.Query("SELECT id, conversation_id, seq FROM messages WHERE expires_at <= NOW() ORDER BY expires_at LIMIT ?", reaperBatchSize)
+	if err != nil {
+		log.Printf("Reaper: query failed: %v", err)
+		return
+	}
+	byConversation := map[int64][]int64{}
+	seqs := map[int64]int64{}
+	for rows.Next() {
+		var id, convID, seq int64
+		if err := rows.Scan(&id, &convID, &seq); err != nil {
+			log.Printf("Reaper: scan failed: %v", err)
+			continue
+		}
+		byConversation[convID] = append(byConversation[convID], id)
+		seqs[id] = seq
+	}
+	rows.Close()
+
+	for convID, ids := range byConversation {
+		placeholders := "?" + strings.Repeat(", ?", len(ids)-1)
+		args := make([]any, len(ids))
+		for i, id := range ids {
+			args[i] = id
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Reaper: begin failed: %v", err)
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM message_status WHERE message_id IN ("+placeholders+")", args...); err != nil {
+			tx.Rollback()
+			log.Printf("Reaper: failed to delete statuses in conversation %d: %v", convID, err)
+			continue
+		}
+		// pins, stars and mentions go with the message (ON DELETE CASCADE)
+		if _, err := tx.Exec("DELETE FROM messages WHERE id IN ("+placeholders+")", args...); err != nil {
+			tx.Rollback()
+			log.Printf("Reaper: failed to delete messages in conversation %d: %v", convID, err)
+			continue
+		}
+		tombstones := "(?, ?, ?)" + strings.Repeat(", (?, ?, ?)", len(ids)-1)
+		tombstoneArgs := make([]any, 0, 3*len(ids))
+		for _, id := range ids {
+			tombstoneArgs = append(tombstoneArgs, id, convID, seqs[id])
+		}
+		if _, err := tx.Exec("INSERT INTO deleted_messages (message_id, conversation_id, seq) VALUES "+tombstones, tombstoneArgs...); err != nil {
+			tx.Rollback()
+			log.Printf("Reaper: failed to record deletions in conversation %d: %v", convID, err)
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Reaper: commit failed for conversation %d: %v", convID, err)
+			continue
+		}
+
+		participantIDs, err := conversationParticipantIDs(convID)
+		if err != nil {
+			log.Printf("Reaper: failed to load participants of conversation %d: %v", convID, err)
+			continue
+		}
+		hub.Events <- Event{
+			RecipientIDs: participantIDs,
+			Payload: MessageExpiredEvent{
+				Type:           "message_expired",
+				ConversationID: convID,
+				MessageIDs:     ids,
+			},
+		}
+	}
+}
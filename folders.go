@@ -0,0 +1,557 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Conversation folders ====
+//
+// Every user can sort their conversations into named folders, shown as tabs
+// in the order they choose:
+//
+//	GET    /api/folders
+//	POST   /api/folders {"name": "Work", "conversation_ids": [29]}
+//	POST   /api/folders {"name": "Groups", "rules": {"types": ["group", "channel"]}}
+//	PATCH  /api/folders/{id} {"name": "...", "rules": {...}}
+//	DELETE /api/folders/{id}
+//	PUT    /api/folders/order {"folder_ids": [3, 1, 2]}
+//	PUT    /api/folders/{id}/conversations/{conversation_id}   manual folders
+//	DELETE /api/folders/{id}/conversations/{conversation_id}
+//
+// A folder is either manual, holding the conversations put in it, or
+// rule-based, holding whatever matches its rules at the time (all of them
+// must match):
+//
+//	types            any of "direct", "group" and "channel" (a public group)
+//	unread           has unread messages or is marked unread
+//	unread_mentions  has unread mentions of the user
+//	muted            true for muted conversations only, false for unmuted
+//
+// GET /api/conversations?folder_id=N lists the conversations in a folder.
+
+const (
+	maxFolders          = 20
+	maxFolderNameLength = 50
+)
+
+var errFolderNotFound = errors.New("folder not found")
+
+type folderRules struct {
+	Types          []string `json:"types,omitempty"`
+	Unread         bool     `json:"unread,omitempty"`
+	UnreadMentions bool     `json:"unread_mentions,omitempty"`
+	Muted          *bool    `json:"muted,omitempty"`
+}
+
+type folderResponse struct {
+	ID              int64        `json:"id"`
+	Name            string       `json:"name"`
+	Kind            string       `json:"kind"` // "manual" or "rule"
+	Rules           *folderRules `json:"rules"`
+	ConversationIDs []int64      `json:"conversation_ids"` // manual folders only
+	Position        int          `json:"position"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+// conversation type -> condition on conversations c
+var folderTypeClauses = map[string]string{
+	"direct":  "c.is_group = 0",
+	"group":   "(c.is_group = 1 AND c.is_public = 0)",
+	"channel": "(c.is_group = 1 AND c.is_public = 1)",
+}
+
+// GET /api/folders
+func listFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	rows, err := db.Query("SELECT id, name, kind, rules, position, created_at FROM folders WHERE user_id = ? ORDER BY position, id", userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	folders := []folderResponse{}
+	for rows.Next() {
+		f, err := scanFolder(rows)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		folders = append(folders, f)
+	}
+	rows.Close()
+
+	for i := range folders {
+		if folders[i].Kind != "manual" {
+			continue
+		}
+		if folders[i].ConversationIDs, err = folderConversationIDs(folders[i].ID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"folders": folders})
+}
+
+// POST /api/folders {"name": "...", "rules": {...} | "conversation_ids": [...]}
+func createFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req struct {
+		Name            string       `json:"name"`
+		Rules           *folderRules `json:"rules"`
+		ConversationIDs []int64      `json:"conversation_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := validateFolderName(&req.Name); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	kind := "manual"
+	var rules sql.NullString
+	if req.Rules != nil {
+		if len(req.ConversationIDs) > 0 {
+			httpError(w, http.StatusBadRequest, "a rule-based folder cannot hold conversation_ids")
+			return
+		}
+		if rules, err = encodeFolderRules(req.Rules); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		kind = "rule"
+	}
+	convIDs := uniqueIDs(req.ConversationIDs)
+	for _, convID := range convIDs {
+		if _, _, err := participantRole(convID, userID); err != nil {
+			if err == errNotParticipant {
+				httpError(w, http.StatusForbidden, fmt.Sprintf("not a participant of conversation %d", convID))
+				return
+			}
+			participantError(w, err)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	// locked so concurrent creates cannot pass the limit together
+	var count, position int
+	err = tx.QueryRow("SELECT COUNT(*), COALESCE(MAX(position), 0) + 1 FROM folders WHERE user_id = ? FOR UPDATE", userID).Scan(&count, &position)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if count >= maxFolders {
+		httpError(w, http.StatusConflict, fmt.Sprintf("you can have at most %d folders", maxFolders))
+		return
+	}
+
+	res, err := tx.Exec("INSERT INTO folders (user_id, name, kind, rules, position) VALUES (?, ?, ?, ?, ?)", userID, req.Name, kind, rules, position)
+	if isDuplicateEntry(err) {
+		httpError(w, http.StatusConflict, "you already have a folder with this name")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	folderID, _ := res.LastInsertId()
+	for _, convID := range convIDs {
+		if _, err := tx.Exec("INSERT INTO folder_conversations (folder_id, conversation_id) VALUES (?, ?)", folderID, convID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	respondFolder(w, http.StatusCreated, folderID, userID)
+}
+
+// PATCH /api/folders/{id} {"name": "...", "rules": {...}}
+//
+// rules can only be changed on rule-based folders.
+func updateFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, folderID, ok := folderRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name  *string      `json:"name"`
+		Rules *folderRules `json:"rules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Name == nil && req.Rules == nil {
+		httpError(w, http.StatusBadRequest, "nothing to update: send name and/or rules")
+		return
+	}
+	folder, err := loadFolder(folderID, userID)
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+
+	var sets []string
+	var args []any
+	if req.Name != nil {
+		if err := validateFolderName(req.Name); err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sets, args = append(sets, "name = ?"), append(args, *req.Name)
+	}
+	if req.Rules != nil {
+		if folder.Kind != "rule" {
+			httpError(w, http.StatusBadRequest, "only rule-based folders have rules")
+			return
+		}
+		rules, err := encodeFolderRules(req.Rules)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sets, args = append(sets, "rules = ?"), append(args, rules)
+	}
+
+	args = append(args, folderID)
+	if _, err := db.Exec("UPDATE folders SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+		if isDuplicateEntry(err) {
+			httpError(w, http.StatusConflict, "you already have a folder with this name")
+			return
+		}
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondFolder(w, http.StatusOK, folderID, userID)
+}
+
+// DELETE /api/folders/{id}
+func deleteFolderHandler(w http.ResponseWriter, r *http.Request) {
+	userID, folderID, ok := folderRequest(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM folders WHERE id = ? AND user_id = ?", folderID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		folderError(w, errFolderNotFound)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"folder_id": folderID, "deleted": true})
+}
+
+// PUT /api/folders/order {"folder_ids": [3, 1, 2]}
+//
+// Every folder of the caller must be listed, once.
+func reorderFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req struct {
+		FolderIDs []int64 `json:"folder_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM folders WHERE user_id = ? FOR UPDATE", userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	owned := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		owned[id] = true
+	}
+	rows.Close()
+
+	ids := uniqueIDs(req.FolderIDs)
+	if len(ids) != len(req.FolderIDs) || len(ids) != len(owned) {
+		httpError(w, http.StatusBadRequest, "folder_ids must list each of your folders once")
+		return
+	}
+	for i, id := range ids {
+		if !owned[id] {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("folder %d is not one of yours", id))
+			return
+		}
+		if _, err := tx.Exec("UPDATE folders SET position = ? WHERE id = ?", i+1, id); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"folder_ids": ids})
+}
+
+// PUT /api/folders/{id}/conversations/{conversation_id}
+func addFolderConversationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, folderID, convID, ok := folderConversationRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, _, err := participantRole(convID, userID); err != nil {
+		participantError(w, err)
+		return
+	}
+
+	_, err := db.Exec("INSERT IGNORE INTO folder_conversations (folder_id, conversation_id) VALUES (?, ?)", folderID, convID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondFolder(w, http.StatusOK, folderID, userID)
+}
+
+// DELETE /api/folders/{id}/conversations/{conversation_id}
+func removeFolderConversationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, folderID, convID, ok := folderConversationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM folder_conversations WHERE folder_id = ? AND conversation_id = ?", folderID, convID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "conversation is not in this folder")
+		return
+	}
+	respondFolder(w, http.StatusOK, folderID, userID)
+}
+
+// folderRequest reads the caller and the {id} path parameter.
+func folderRequest(w http.ResponseWriter, r *http.Request) (userID, folderID int64, ok bool) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return 0, 0, false
+	}
+	folderID, err = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid folder id")
+		return 0, 0, false
+	}
+	return userID, folderID, true
+}
+
+// folderConversationRequest is folderRequest plus {conversation_id}, for a
+// manual folder of the caller.
+func folderConversationRequest(w http.ResponseWriter, r *http.Request) (userID, folderID, convID int64, ok bool) {
+	userID, folderID, ok = folderRequest(w, r)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	convID, err := strconv.ParseInt(mux.Vars(r)["conversation_id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid conversation id")
+		return 0, 0, 0, false
+	}
+	folder, err := loadFolder(folderID, userID)
+	if err != nil {
+		folderError(w, err)
+		return 0, 0, 0, false
+	}
+	if folder.Kind != "manual" {
+		httpError(w, http.StatusBadRequest, "rule-based folders pick their conversations themselves")
+		return 0, 0, 0, false
+	}
+	return userID, folderID, convID, true
+}
+
+// respondFolder answers with the current state of a folder.
+func respondFolder(w http.ResponseWriter, status int, folderID, userID int64) {
+	folder, err := loadFolder(folderID, userID)
+	if err != nil {
+		folderError(w, err)
+		return
+	}
+	if folder.Kind == "manual" {
+		if folder.ConversationIDs, err = folderConversationIDs(folderID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+	respondJSON(w, status, map[string]any{"folder": folder})
+}
+
+// folderError maps an error from loadFolder to a response.
+func folderError(w http.ResponseWriter, err error) {
+	if err == errFolderNotFound {
+		httpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+}
+
+// loadFolder reads one of userID's folders, without its conversations.
+func loadFolder(folderID, userID int64) (folderResponse, error) {
+	f, err := scanFolder(db.QueryRow("SELECT id, name, kind, rules, position, created_at FROM folders WHERE id = ? AND user_id = ?", folderID, userID))
+	if err == sql.ErrNoRows {
+		return f, errFolderNotFound
+	}
+	return f, err
+}
+
+func scanFolder(row rowScanner) (folderResponse, error) {
+	var f folderResponse
+	var rules sql.NullString
+	if err := row.Scan(&f.ID, &f.Name, &f.Kind, &rules, &f.Position, &f.CreatedAt); err != nil {
+		return f, err
+	}
+	if rules.Valid {
+		f.Rules = &folderRules{}
+		if err := json.Unmarshal([]byte(rules.String), f.Rules); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func folderConversationIDs(folderID int64) ([]int64, error) {
+	rows, err := db.Query("SELECT conversation_id FROM folder_conversations WHERE folder_id = ? ORDER BY added_at, id", folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func validateFolderName(name *string) error {
+	*name = strings.TrimSpace(*name)
+	if *name == "" || utf8.RuneCountInString(*name) > maxFolderNameLength {
+		return fmt.Errorf("name must be 1 to %d characters", maxFolderNameLength)
+	}
+	return nil
+}
+
+// encodeFolderRules checks rules and returns them as stored.
+func encodeFolderRules(rules *folderRules) (sql.NullString, error) {
+	seen := map[string]bool{}
+	types := []string{}
+	for _, t := range rules.Types {
+		if _, ok := folderTypeClauses[t]; !ok {
+			return sql.NullString{}, fmt.Errorf("unknown conversation type %q: use direct, group or channel", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	rules.Types = types
+	if len(rules.Types) == 0 && !rules.Unread && !rules.UnreadMentions && rules.Muted == nil {
+		return sql.NullString{}, errors.New("rules must set at least one of types, unread, unread_mentions or muted")
+	}
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// folderClauses returns the conditions listConversationsHandler adds for a
+// folder: WHERE clauses with their arguments, and HAVING clauses on its
+// unread_count, unread_mention_count and marked_unread columns.
+func folderClauses(folderID, userID int64) (where []string, args []any, having []string, err error) {
+	folder, err := loadFolder(folderID, userID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if folder.Kind == "manual" {
+		return []string{"c.id IN (SELECT conversation_id FROM folder_conversations WHERE folder_id = ?)"}, []any{folderID}, nil, nil
+	}
+
+	rules := folder.Rules
+	if rules == nil {
+		rules = &folderRules{}
+	}
+	if len(rules.Types) > 0 {
+		var types []string
+		for _, t := range rules.Types {
+			types = append(types, folderTypeClauses[t])
+		}
+		where = append(where, "("+strings.Join(types, " OR ")+")")
+	}
+	if rules.Muted != nil {
+		if *rules.Muted {
+			where = append(where, "cp.muted_until > NOW()")
+		} else {
+			where = append(where, "(cp.muted_until IS NULL OR cp.muted_until <= NOW())")
+		}
+	}
+	if rules.Unread {
+		having = append(having, "(unread_count > 0 OR marked_unread = 1)")
+	}
+	if rules.UnreadMentions {
+		having = append(having, "unread_mention_count > 0")
+	}
+	return where, nil, having, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Forwarding ====
+//
+// POST /api/messages/{id}/forward {"conversation_ids": [..]}
+//
+// The message is copied into each target conversation through Hub.Deliver, so
+// the copies are saved, fanned out and mention-parsed exactly like a message
+// sent over the WebSocket. Media messages carry their file URL in content, so
+// copying the content carries the attachment along.
+//
+// Each copy keeps a forwarded_from reference to the original message. The
+// original sender is only named if their forward_attribution privacy setting
+// allows it. Forwarding a forward points back at the original, not the hop.
+
+const maxForwardTargets = 10
+
+// forwardRef is the forwarded_from field of a message.
+type forwardRef struct {
+	MessageID int64  `json:"message_id"`
+	SenderID  *int64 `json:"sender_id,omitempty"` // nil when the original sender hides attribution
+}
+
+func newForwardRef(messageID, senderID sql.NullInt64) *forwardRef {
+	if !messageID.Valid {
+		return nil
+	}
+	ref := &forwardRef{MessageID: messageID.Int64}
+	if senderID.Valid {
+		ref.SenderID = &senderID.Int64
+	}
+	return ref
+}
+
+func forwardMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	msgID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	var req struct {
+		ConversationIDs []int64 `json:"conversation_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	targets := uniqueIDs(req.ConversationIDs)
+	if len(targets) == 0 {
+		httpError(w, http.StatusBadRequest, "conversation_ids required")
+		return
+	}
+	if len(targets) > maxForwardTargets {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("a message can be forwarded to at most %d conversations at once", maxForwardTargets))
+		return
+	}
+
+	// Load the source and work out what the copies point back to
+	var src Message
+	var fwdMessageID, fwdSenderID sql.NullInt64
+	var payload sql.NullString
+	var senderAttribution bool
+	err = db.QueryRow(`
+		SELECT m.conversation_id, m.sender_id, m.content, m.message_type, m.payload,
+		       m.forwarded_from_message_id, m.forwarded_from_user_id, u.forward_attribution
+		FROM messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.id = ?`, msgID).
+		Scan(&src.ConversationID, &src.SenderID, &src.Content, &src.MessageType, &payload, &fwdMessageID, &fwdSenderID, &senderAttribution)
+	if err == sql.ErrNoRows {
+		httpError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if src.MessageType == "system" || src.MessageType == "poll" {
+		httpError(w, http.StatusBadRequest, src.MessageType+" messages cannot be forwarded")
+		return
+	}
+
+	ref := newForwardRef(fwdMessageID, fwdSenderID)
+	if ref == nil {
+		ref = &forwardRef{MessageID: msgID}
+		if senderAttribution {
+			ref.SenderID = &src.SenderID
+		}
+	}
+
+	// The forwarder must be in the source and allowed to post in every target
+	if _, _, err := participantRole(src.ConversationID, userID); err != nil {
+		participantError(w, err)
+		return
+	}
+	for _, convID := range targets {
+		if err := checkCanPost(convID, userID); err != nil {
+			if err == errAnnouncementOnly {
+				httpError(w, http.StatusForbidden, fmt.Sprintf("only admins can post in conversation %d", convID))
+				return
+			}
+			if err == errNotParticipant {
+				httpError(w, http.StatusForbidden, fmt.Sprintf("not a participant of conversation %d", convID))
+				return
+			}
+			participantError(w, err)
+			return
+		}
+	}
+
+	copies := []Message{}
+	for _, convID := range targets {
+		stored, err := hub.Deliver(Message{
+			ConversationID: convID,
+			SenderID:       userID,
+			Content:        src.Content,
+			MessageType:    src.MessageType,
+			ForwardedFrom:  ref,
+			richPayload:    decodeRichPayload(msgID, src.MessageType, payload),
+		})
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, fmt.Sprintf("failed to forward to conversation %d: %v", convID, err))
+			return
+		}
+		copies = append(copies, stored)
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]any{"messages": copies})
+}
+
+// PUT /api/users/me/privacy {"forward_attribution": false, "discoverable": false}
+//
+// forward_attribution controls whether copies of your messages forwarded
+// elsewhere name you as the original sender. discoverable controls whether
+// strangers find you in the user directory (see directory.go). Either may be
+// left out.
+func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var req struct {
+		ForwardAttribution *bool `json:"forward_attribution"`
+		Discoverable       *bool `json:"discoverable"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.ForwardAttribution == nil && req.Discoverable == nil {
+		httpError(w, http.StatusBadRequest, "forward_attribution or discoverable required")
+		return
+	}
+
+	if req.ForwardAttribution != nil {
+		if _, err := db.Exec("UPDATE users SET forward_attribution = ? WHERE id = ?", *req.ForwardAttribution, userID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+	if req.Discoverable != nil {
+		if _, err := db.Exec("UPDATE users SET discoverable = ? WHERE id = ?", *req.Discoverable, userID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+
+	var forwardAttribution, discoverable bool
+	if err := db.QueryRow("SELECT forward_attribution, discoverable FROM users WHERE id = ?", userID).Scan(&forwardAttribution, &discoverable); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"forward_attribution": forwardAttribution, "discoverable": discoverable})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+)
+
+// ==== Idempotent sends ====
+//
+// Clients may tag a message with a client_msg_id (unique per sender, stored
+// in messages.client_msg_id with a unique key). Sending the same ID again,
+// e.g. when index.html resends after a reconnect, returns the message that
+// was stored the first time instead of inserting a new row. Over the
+// WebSocket the sender gets an "ack" frame mapping the client ID to the
+// server ID, both for the first delivery and for every retry.
+//
+// IDs starting with "scheduled:" are reserved for the scheduler (see
+// scheduled.go).
+
+const (
+	maxClientMsgIDLength = 64
+	scheduledClientMsgID = "scheduled:"
+)
+
+// validateClientMsgID checks a client_msg_id sent by a client.
+func validateClientMsgID(id string) error {
+	if len(id) > maxClientMsgIDLength {
+		return fmt.Errorf("client_msg_id must be at most %d characters", maxClientMsgIDLength)
+	}
+	if strings.HasPrefix(id, scheduledClientMsgID) {
+		return errors.New(`client_msg_id must not start with "` + scheduledClientMsgID + `"`)
+	}
+	return nil
+}
+
+// AckEvent confirms to the sender that a client_msg_id has been stored.
+type AckEvent struct {
+	Type           string `json:"type"` // "ack"
+	ClientMsgID    string `json:"client_msg_id"`
+	MessageID      int64  `json:"message_id"`
+	ConversationID int64  `json:"conversation_id"`
+	Seq            int64  `json:"seq"`
+	CreatedAt      string `json:"created_at"`
+	Duplicate      bool   `json:"duplicate"` // true when this was a retry of a stored message
+}
+
+func newAckEvent(msg Message, duplicate bool) AckEvent {
+	return AckEvent{
+		Type:           "ack",
+		ClientMsgID:    msg.ClientMsgID,
+		MessageID:      msg.ID,
+		ConversationID: msg.ConversationID,
+		Seq:            msg.Seq,
+		CreatedAt:      msg.CreatedAt,
+		Duplicate:      duplicate,
+	}
+}
+
+// findClientMessage returns the message a sender already stored under
+// clientMsgID, or sql.ErrNoRows.
+func findClientMessage(senderID int64, clientMsgID string) (Message, error) {
+	var msg Message
+	var createdAt time.Time
+	err := db.QueryRow(`
+		SELECT id, conversation_id, seq, sender_id, content, message_type, client_msg_id, created_at
+		FROM messages WHERE sender_id = ? AND client_msg_id = ?`, senderID, clientMsgID).
+		Scan(&msg.ID, &msg.ConversationID, &msg.Seq, &msg.SenderID, &msg.Content, &msg.MessageType, &msg.ClientMsgID, &createdAt)
+	if err != nil {
+		return msg, err
+	}
+	msg.CreatedAt = createdAt.Format(time.RFC3339)
+	return msg, nil
+}
+
+// replayDuplicate answers a retried message from the Run goroutine: the
+// sender gets an ack for the original and Deliver callers get the original
+// back. It returns false if the client_msg_id has not been stored yet.
+func (h *Hub) replayDuplicate(message Message) bool {
+	if message.ClientMsgID == "" {
+		return false
+	}
+	orig, err := findClientMessage(message.SenderID, message.ClientMsgID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to look up client_msg_id %q of user %d: %v", message.ClientMsgID, message.SenderID, err)
+		}
+		return false
+	}
+
+	h.sendTo([]int64{message.SenderID}, newAckEvent(orig, true))
+	if message.reply != nil {
+		message.reply <- deliveryResult{Message: orig, Duplicate: true}
+	}
+	return true
+}
+
+// respondStoredClientMessage answers an HTTP retry with the stored original
+// (200 instead of 201). It returns false if nothing was stored under the ID.
+func respondStoredClientMessage(w http.ResponseWriter, senderID int64, clientMsgID string) bool {
+	orig, err := findClientMessage(senderID, clientMsgID)
+	if err != nil {
+		return false
+	}
+	msgs, err := queryMessages(senderID, "SELECT "+messageColumns+" FROM messages m WHERE m.id = ?", orig.ID)
+	if err != nil || len(msgs) == 0 {
+		return false
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"message": msgs[0]})
+	return true
+}
+
+func isDuplicateEntry(err error) bool {
+	me, ok := err.(*mysqlDriver.MySQLError)
+	return ok && me.Number == 1062
+}
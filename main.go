@@ -3,13 +3,15 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	_ "fmt"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql"
 	mysqlDriver "github.com/go-sql-driver/mysql"
@@ -31,6 +33,16 @@ var ADDR = getEnv("CHAT_ADDR", ":8080")
 var jwtKey = []byte("my_secret_key")
 
 var db *sql.DB
+
+var errNotParticipant = errors.New("user is not a participant of this conversation")
+
+// participant roles (conversation_participants.role)
+const (
+	roleOwner  = "owner"
+	roleAdmin  = "admin"
+	roleMember = "member"
+)
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // allow all origins for testing
@@ -39,11 +51,12 @@ var upgrader = websocket.Upgrader{
 
 // User model (matches chat_app.users exactly)
 type User struct {
-	ID        int64      `json:"id"`
-	Username  string     `json:"username"`
-	Status    string     `json:"status"`
-	LastSeen  *time.Time `json:"last_seen,omitempty"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID          int64      `json:"id"`
+	Username    string     `json:"username"`
+	DisplayName string     `json:"display_name,omitempty"`
+	Status      string     `json:"status"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
 }
 
 // request payload for register
@@ -66,30 +79,69 @@ type createConversationRequest struct {
 	ParticipantIDs []int64 `json:"participant_ids"`
 	Name           string  `json:"name"`
 	IsGroup        bool    `json:"is_group"`
+
+	// Groups only, see channels.go and announcements.go
+	IsPublic         bool   `json:"is_public"`
+	AnnouncementOnly bool   `json:"announcement_only"`
+	Topic            string `json:"topic"`
+	Description      string `json:"description"`
 }
 
 type conversationResponse struct {
-	ID             int64     `json:"id"`
-	Name           string    `json:"name"`
-	IsGroup        bool      `json:"is_group"`
-	ParticipantIDs []int64   `json:"participant_ids"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID               int64     `json:"id"`
+	Name             string    `json:"name"`
+	IsGroup          bool      `json:"is_group"`
+	IsPublic         bool      `json:"is_public"`         // a public channel, see channels.go
+	AnnouncementOnly bool      `json:"announcement_only"` // only owners and admins post, see announcements.go
+	ParticipantIDs   []int64   `json:"participant_ids"`
+	CreatedAt        time.Time `json:"created_at"`
+
+	// Disappearing messages; MessageTTL is in seconds, 0 when off
+	MessageTTL int64  `json:"message_ttl"`
+	TTLMode    string `json:"ttl_mode"`
+
+	Topic       string `json:"topic"`
+	Description string `json:"description"`
+
+	// Only filled in by listConversationsHandler for the requesting user
+	*participantSettings
+	UnreadCount        int       `json:"unread_count"`
+	UnreadMentionCount int       `json:"unread_mention_count"`
+	LastActivityAt     time.Time `json:"last_activity_at"`
 }
 
 type sendMessageRequest struct {
 	ConversationID int64  `json:"conversation_id"`
 	SenderID       int64  `json:"sender_id"`
 	Content        string `json:"content"`
-	MessageType    string `json:"message_type"` // text, image, video, file
+	MessageType    string `json:"message_type"` // text, image, video, file, location, contact, voice
+
+	// location, contact or voice, matching message_type (see payloads.go)
+	richPayload
+
+	// SendAt schedules the message instead of sending it now (see scheduled.go)
+	SendAt *time.Time `json:"send_at,omitempty"`
+
+	// ClientMsgID makes retries safe (see idempotency.go)
+	ClientMsgID string `json:"client_msg_id,omitempty"`
 }
 
 type messageResponse struct {
-	ID             int64     `json:"id"`
-	ConversationID int64     `json:"conversation_id"`
-	SenderID       int64     `json:"sender_id"`
-	Content        string    `json:"content"`
-	MessageType    string    `json:"message_type"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID             int64           `json:"id"`
+	ConversationID int64           `json:"conversation_id"`
+	Seq            int64           `json:"seq"` // position in the conversation, see seq.go
+	SenderID       int64           `json:"sender_id"`
+	Content        string          `json:"content"`
+	Text           string          `json:"text"` // content without Markdown markers, see markdown.go
+	Entities       []textEntity    `json:"entities,omitempty"`
+	MessageType    string          `json:"message_type"`
+	Mentions       []mentionEntity `json:"mentions,omitempty"`
+	ForwardedFrom  *forwardRef     `json:"forwarded_from,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+	ClientMsgID    string          `json:"client_msg_id,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+
+	richPayload
 }
 
 // StatusUpdate Add this struct near your other data models (User, Message, etc.)
@@ -102,6 +154,11 @@ type StatusUpdate struct {
 type Client struct {
 	ID   int64
 	Conn *websocket.Conn
+
+	// Owned by the Run goroutine: while a sync backlog is being written,
+	// live frames are held here instead (see sync.go)
+	syncing bool
+	held    []any
 }
 
 type Hub struct {
@@ -109,16 +166,54 @@ type Hub struct {
 	Register   chan *Client
 	Unregister chan *Client
 	Broadcast  chan Message
+	Events     chan Event
+	SyncStart  chan *Client
+	SyncDone   chan syncDone
+}
+
+// Event is a transient frame (typing, presence, ...) that is pushed to the
+// given users as-is and never written to the database.
+type Event struct {
+	RecipientIDs []int64
+	Payload      any
+}
+
+// inboundFrame is peeked from every WebSocket frame to route it by type.
+// Frames without a type are chat messages, as sent by the original client.
+type inboundFrame struct {
+	Type           string `json:"type"`
+	ConversationID int64  `json:"conversation_id"`
 }
 
 type Message struct {
-	ID             int64   `json:"id"`
-	ConversationID int64   `json:"conversation_id"`
-	SenderID       int64   `json:"sender_id"`
-	Content        string  `json:"content"`
-	MessageType    string  `json:"message_type"`
-	RecipientIDs   []int64 `json:"recipient_ids"`
-	CreatedAt      string  `json:"created_at"`
+	ID             int64           `json:"id"`
+	ConversationID int64           `json:"conversation_id"`
+	Seq            int64           `json:"seq"` // position in the conversation, see seq.go
+	SenderID       int64           `json:"sender_id"`
+	Content        string          `json:"content"`
+	Text           string          `json:"text"` // content without Markdown markers, see markdown.go
+	Entities       []textEntity    `json:"entities,omitempty"`
+	MessageType    string          `json:"message_type"`
+	Mentions       []mentionEntity `json:"mentions,omitempty"`
+	ForwardedFrom  *forwardRef     `json:"forwarded_from,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+	ClientMsgID    string          `json:"client_msg_id,omitempty"`
+	RecipientIDs   []int64         `json:"recipient_ids,omitempty"` // left out in announcement channels
+	CreatedAt      string          `json:"created_at"`
+
+	richPayload
+
+	// announcement marks a message posted in an announcement channel, see announcements.go
+	announcement bool
+
+	// reply, when set, receives the stored message once the Hub is done with it
+	reply chan<- deliveryResult
+}
+
+type deliveryResult struct {
+	Message   Message
+	Duplicate bool // the client_msg_id was already stored; Message is the original
+	Err       error
 }
 
 var hub = Hub{
@@ -126,6 +221,9 @@ var hub = Hub{
 	Register:   make(chan *Client),
 	Unregister: make(chan *Client),
 	Broadcast:  make(chan Message),
+	Events:     make(chan Event, 64),
+	SyncStart:  make(chan *Client),
+	SyncDone:   make(chan syncDone),
 }
 
 // ==== Hub run loop ====
@@ -179,93 +277,180 @@ func (h *Hub) Run() {
 			log.Printf("User %d connected, total clients: %d", client.ID, len(h.Clients))
 
 		case client := <-h.Unregister:
-			if _, ok := h.Clients[client.ID]; ok {
+			// A reconnect may already have replaced this connection
+			if c, ok := h.Clients[client.ID]; ok && c == client {
 				client.Conn.Close()
 				delete(h.Clients, client.ID)
 				log.Printf("User %d disconnected, total clients: %d", client.ID, len(h.Clients))
 			}
 
 		case message := <-h.Broadcast:
+			// A retry of something we already stored only gets acked
+			if h.replayDuplicate(message) {
+				continue
+			}
+
 			// Save message to DB and get recipients
-			msgID, recipientIDs, err := saveMessage(message) // <-- Capture recipientIDs
+			err := saveMessage(&message)
 			if err != nil {
+				// Lost a race with sendMessageHandler for the same client_msg_id
+				if isDuplicateEntry(err) && h.replayDuplicate(message) {
+					continue
+				}
 				log.Printf("Failed to save message: %v", err)
+				if message.reply != nil {
+					message.reply <- deliveryResult{Err: err}
+				}
+				continue
+			}
+			if message.ExpiresAt, err = applyMessageTTL(message.ID); err != nil {
+				log.Printf("Failed to apply TTL to message %d: %v", message.ID, err)
+			}
+
+			// System messages quote names and topics but never notify anyone
+			var mentioned []mentionedUser
+			if message.MessageType != "system" {
+				message.Mentions, mentioned, err = saveMentions(message.ID, message.ConversationID, message.SenderID, message.Text)
+				if err != nil {
+					log.Printf("Failed to save mentions for message %d: %v", message.ID, err)
+				}
+			}
+
+			// Broadcast to recipients; a large audience is not repeated in every frame
+			frame := message
+			if message.announcement {
+				frame.RecipientIDs = nil
+			}
+			h.sendTo(message.RecipientIDs, frame)
+
+			// Mentioned users get a distinct event on top of the message itself
+			for _, event := range mentionEvents(message.ID, message.ConversationID, message.SenderID, message.Text, mentioned) {
+				h.sendTo(event.RecipientIDs, event.Payload)
+			}
+
+			if message.ClientMsgID != "" {
+				h.sendTo([]int64{message.SenderID}, newAckEvent(message, false))
+			}
+
+			if message.reply != nil {
+				message.reply <- deliveryResult{Message: message}
+			}
+
+		case event := <-h.Events:
+			// Transient events skip the DB and go straight to whoever is online
+			h.sendTo(event.RecipientIDs, event.Payload)
+
+		case client := <-h.SyncStart:
+			client.syncing = true
+
+		case done := <-h.SyncDone:
+			h.finishSync(done)
+		}
+	}
+}
+
+// Deliver pushes msg through the same save-and-broadcast path as frames read
+// by wsHandler and waits for the stored copy (with its ID and recipients).
+// Use it from HTTP handlers and background jobs, never from Run itself.
+func (h *Hub) Deliver(msg Message) (Message, error) {
+	reply := make(chan deliveryResult, 1)
+	msg.reply = reply
+	h.Broadcast <- msg
+	res := <-reply
+	return res.Message, res.Err
+}
+
+// sendTo writes payload to every listed user that is connected, dropping
+// clients whose connection fails. The payload is encoded once, however many
+// users get it. Only call it from the Run goroutine.
+func (h *Hub) sendTo(userIDs []int64, payload any) {
+	var frame []byte
+	for _, uid := range userIDs {
+		if c, ok := h.Clients[uid]; ok {
+			if c.syncing {
+				c.held = append(c.held, payload)
 				continue
 			}
-			message.ID = msgID
-
-			// CRITICAL: Set the recipients before broadcasting
-			message.RecipientIDs = recipientIDs
-
-			loc, _ := time.LoadLocation("Africa/Nairobi")
-			// Note: The original code re-calculates time here.
-			message.CreatedAt = time.Now().In(loc).Format(time.RFC3339)
-			// ISO string
-
-			// Broadcast to recipients
-			for _, uid := range message.RecipientIDs {
-				if c, ok := h.Clients[uid]; ok {
-					if err := c.Conn.WriteJSON(message); err != nil {
-						log.Printf("Error sending message to user %d: %v", uid, err)
-						c.Conn.Close()
-						delete(h.Clients, uid)
-					}
+			if frame == nil {
+				var err error
+				if frame, err = json.Marshal(payload); err != nil {
+					log.Printf("Error encoding frame: %v", err)
+					return
 				}
 			}
+			h.writeFrame(c, frame)
 		}
 	}
 }
 
+// write sends one frame to c and drops the client if that fails.
+func (h *Hub) write(c *Client, payload any) bool {
+	frame, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding frame for user %d: %v", c.ID, err)
+		return true
+	}
+	return h.writeFrame(c, frame)
+}
+
+// writeFrame sends an encoded frame to c and drops the client if that fails.
+func (h *Hub) writeFrame(c *Client, frame []byte) bool {
+	if err := c.Conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		log.Printf("Error sending to user %d: %v", c.ID, err)
+		c.Conn.Close()
+		delete(h.Clients, c.ID)
+		return false
+	}
+	return true
+}
+
 // ==== Save message to DB ====
 //
 
 // ==== Save message to DB and fetch recipients ====
-func saveMessage(msg Message) (int64, []int64, error) { // <-- Added []int64 return
-	// Convert CreatedAt string to time.Time
-	createdAt, err := time.Parse(time.RFC3339, msg.CreatedAt)
+// saveMessage stores msg and fills in its ID, seq, creation time (as an ISO
+// string in Nairobi time) and recipients, writing a message_status row for
+// every participant.
+func saveMessage(msg *Message) error {
+	// Only members can post, only admins in announcement channels; system
+	// messages are the server's own
+	if msg.MessageType != "system" {
+		if err := checkCanPost(msg.ConversationID, msg.SenderID); err != nil {
+			return err
+		}
+	}
+	announcement, err := isAnnouncementOnly(msg.ConversationID)
 	if err != nil {
-		createdAt = time.Now().UTC()
+		return err
 	}
 
-	res, err := db.Exec(
-		"INSERT INTO messages (conversation_id, sender_id, content, message_type, created_at) VALUES (?, ?, ?, ?, ?)",
-		msg.ConversationID, msg.SenderID, msg.Content, msg.MessageType, createdAt,
-	)
+	msgID, seq, createdAt, err := insertMessage(msg)
 	if err != nil {
-		return 0, nil, err // Return nil for recipients on error
+		return err
 	}
-	msgID, _ := res.LastInsertId()
-
-	// --- New/Improved Logic: Fetch all participant IDs ---
-	var recipientIDs []int64
+	if msg.MessageType != "system" {
+		if err := unarchiveOnMessage(msg.ConversationID); err != nil {
+			log.Printf("Failed to unarchive conversation %d: %v", msg.ConversationID, err)
+		}
+	}
+	loc, _ := time.LoadLocation("Africa/Nairobi")
+	msg.ID, msg.Seq, msg.CreatedAt = msgID, seq, createdAt.In(loc).Format(time.RFC3339)
 
-	// Fetch all participants for the conversation
-	rows, err := db.Query(`
-        SELECT user_id, status
-        FROM conversation_participants cp
-        JOIN users u ON cp.user_id = u.id
-        WHERE conversation_id = ?`, msg.ConversationID)
+	// Fetch the participants to push it to
+	recipientIDs, err := messageRecipientIDs(msg.ConversationID)
 	if err != nil {
-		return msgID, nil, err
+		return err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var uid int64
-		var status string
-		rows.Scan(&uid, &status)
-
-		recipientIDs = append(recipientIDs, uid) // Collect recipient ID
-
-		mStatus := "sent"
-		if status == "online" {
-			mStatus = "delivered"
+	// Note: a status row is written for *all* users, including the sender, which is fine.
+	if !announcement {
+		if err := recordMessageStatus(msgID, msg.ConversationID); err != nil {
+			log.Printf("Failed to record status of message %d: %v", msgID, err)
 		}
-		// Note: The original code inserts status for *all* users, including the sender, which is fine.
-		db.Exec("INSERT INTO message_status (message_id, user_id, status) VALUES (?, ?, ?)", msgID, uid, mStatus)
 	}
 
-	return msgID, recipientIDs, nil // <-- Return the list of recipients
+	msg.RecipientIDs = recipientIDs // <-- Set the recipients before broadcasting
+	msg.announcement = announcement
+	return nil
 }
 
 // ==== WebSocket handler ====
@@ -289,25 +474,78 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 
 	client := &Client{ID: userID, Conn: conn}
 	hub.Register <- client
-	defer func() { hub.Unregister <- client }()
+	defer func() {
+		typing.StopAll(userID)
+		hub.Unregister <- client
+	}()
 
 	// Send initial message
 	conn.WriteJSON(map[string]string{"message": "connected to chat server"})
 
 	for {
-		var msg Message
-		if err := conn.ReadJSON(&msg); err != nil {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket closed for user %d: %v", userID, err)
 			}
 			break
 		}
 
-		// Set timestamp in ISO string for DB
-		loc, _ := time.LoadLocation("Africa/Nairobi")
-		msg.CreatedAt = time.Now().In(loc).Format(time.RFC3339)
-		hub.Broadcast <- msg
+		var frame inboundFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			log.Printf("Invalid frame from user %d: %v", userID, err)
+			continue
+		}
+
+		switch frame.Type {
+		case "typing_start":
+			typing.Start(frame.ConversationID, userID)
 
+		case "typing_stop":
+			typing.Stop(frame.ConversationID, userID)
+
+		case "sync":
+			var req syncFrame
+			if err := json.Unmarshal(data, &req); err != nil {
+				log.Printf("Invalid sync frame from user %d: %v", userID, err)
+				continue
+			}
+			syncClient(client, req)
+
+		case "", "message":
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				log.Printf("Invalid message from user %d: %v", userID, err)
+				continue
+			}
+			if err := validateClientMsgID(msg.ClientMsgID); err != nil {
+				log.Printf("Dropping message from user %d: %v", userID, err)
+				continue
+			}
+			// Slash commands are run instead of saved (see commands.go)
+			if name, args, ok := parseCommand(msg.MessageType, &msg.Content); ok {
+				typing.Stop(msg.ConversationID, userID)
+				c := &commandContext{ConversationID: msg.ConversationID, UserID: userID, Name: name, Args: args, ClientMsgID: msg.ClientMsgID}
+				runCommand(c)
+				c.flush()
+				continue
+			}
+			if err := validateMessageBody(msg.ConversationID, &msg.MessageType, &msg.Content, &msg.richPayload); err != nil {
+				log.Printf("Dropping message from user %d: %v", userID, err)
+				continue
+			}
+
+			// Only forwardMessageHandler marks a message as forwarded
+			msg.ForwardedFrom = nil
+
+			// Sending a message ends the typing state for that conversation
+			typing.Stop(msg.ConversationID, userID)
+
+			hub.Broadcast <- msg
+
+		default:
+			log.Printf("Unknown frame type %q from user %d", frame.Type, userID)
+		}
 	}
 }
 
@@ -315,7 +553,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusNoContent)
@@ -344,6 +582,9 @@ func main() {
 	log.Println("connected to DB (chat_app)")
 
 	go hub.Run()
+	go runScheduler()
+	go runReaper()
+	go runPollCloser()
 	// router
 	r := mux.NewRouter()
 	r.Use(corsMiddleware)
@@ -353,10 +594,56 @@ func main() {
 	api.HandleFunc("/login", loginHandler).Methods("POST", "OPTIONS")
 	api.HandleFunc("/logout", logoutHandler).Methods("POST", "OPTIONS")
 	api.HandleFunc("/users", listUsersHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/users/me", updateProfileHandler).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/users/me/blocks", listBlocksHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/users/me/blocks/{user_id}", blockUserHandler).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/users/me/blocks/{user_id}", unblockUserHandler).Methods("DELETE", "OPTIONS")
 	api.HandleFunc("/conversations", createConversationHandler).Methods("POST", "OPTIONS")
 	api.HandleFunc("/conversations", listConversationsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/conversations/{id}", updateConversationHandler).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/participants", addParticipantsHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/participants/{user_id}", removeParticipantHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/join", joinChannelHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/accept", acceptMessageRequestHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/decline", declineMessageRequestHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/leave", leaveConversationHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/channels", listChannelsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/folders", listFoldersHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/folders", createFolderHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/folders/order", reorderFoldersHandler).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/folders/{id}", updateFolderHandler).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/folders/{id}", deleteFolderHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/folders/{id}/conversations/{conversation_id}", addFolderConversationHandler).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/folders/{id}/conversations/{conversation_id}", removeFolderConversationHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/contacts", listContactsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/contacts/{user_id}", removeContactHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/contacts/requests", listContactRequestsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/contacts/requests", sendContactRequestHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/contacts/requests/{user_id}/accept", acceptContactRequestHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/contacts/requests/{user_id}/decline", declineContactRequestHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/settings", updateConversationSettingsHandler).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/read", markConversationReadHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/pins", listPinsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/pins", pinMessageHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/pins/{message_id}", unpinMessageHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/conversations/{id}/ttl", updateConversationTTLHandler).Methods("PUT", "OPTIONS")
 	api.HandleFunc("/messages", sendMessageHandler).Methods("POST", "OPTIONS")
 	api.HandleFunc("/messages", listMessagesHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/search/messages", searchMessagesHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/users/me/mentions", listMentionsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/users/me/starred", listStarredHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/messages/{id}/star", starMessageHandler).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/messages/{id}/star", unstarMessageHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/messages/{id}/forward", forwardMessageHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/messages/{id}/votes", votePollHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/messages/{id}/votes", retractVoteHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/users/me/privacy", updatePrivacyHandler).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/commands", listCommandsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/bots/commands", registerBotCommandHandler).Methods("POST", "OPTIONS")
+	api.HandleFunc("/bots/commands/{name}", deleteBotCommandHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/scheduled-messages", listScheduledMessagesHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/scheduled-messages/{id}", updateScheduledMessageHandler).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/scheduled-messages/{id}", cancelScheduledMessageHandler).Methods("DELETE", "OPTIONS")
 
 	r.HandleFunc("/ws", wsHandler)
 
@@ -439,8 +726,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	// fetch user
 	u := User{}
 	var passwordHash string
-	err := db.QueryRow("SELECT id, username, password_hash, status, last_seen, created_at FROM users WHERE username = ?", req.Username).
-		Scan(&u.ID, &u.Username, &passwordHash, &u.Status, &u.LastSeen, &u.CreatedAt)
+	err := db.QueryRow("SELECT id, username, COALESCE(display_name, ''), password_hash, status, last_seen, created_at FROM users WHERE username = ?", req.Username).
+		Scan(&u.ID, &u.Username, &u.DisplayName, &passwordHash, &u.Status, &u.LastSeen, &u.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			httpError(w, http.StatusUnauthorized, "invalid credentials")
@@ -471,22 +758,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	//u.LastSeen = &now
 
 	// --- ADDED: Broadcast Online Status ---
-	statusMsg := StatusUpdate{
-		Type:      "status_update",
-		UserID:    u.ID,
-		NewStatus: "online",
-	}
-	// Broadcast the status change (we'll create a dedicated broadcast channel later)
-	// For now, we can write directly to all connected clients in the Hub
-	go func() {
-		for _, client := range hub.Clients {
-			if client.ID != u.ID { // Don't send status update to self (they know they logged in)
-				if err := client.Conn.WriteJSON(statusMsg); err != nil {
-					log.Printf("Error broadcasting status update to user %d: %v", client.ID, err)
-				}
-			}
-		}
-	}()
+	// Only to those allowed to see it, see contacts.go
+	broadcastStatus(u.ID, "online")
 	// --- END ADDED ---
 
 	// create JWT token
@@ -502,28 +775,6 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, loginResponse{User: u, Token: tokenStr})
 }
 
-// listing users
-func listUsersHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, username, status, last_seen, created_at FROM users ORDER BY username ASC")
-	if err != nil {
-		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
-		return
-	}
-	defer rows.Close()
-
-	users := []User{}
-	for rows.Next() {
-		u := User{}
-		if err := rows.Scan(&u.ID, &u.Username, &u.Status, &u.LastSeen, &u.CreatedAt); err != nil {
-			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
-			return
-		}
-		users = append(users, u)
-	}
-
-	respondJSON(w, http.StatusOK, map[string]any{"users": users})
-}
-
 // Add this StatusUpdate struct somewhere with your other data models (e.g., User, Message)
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
@@ -562,26 +813,9 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// --- START: Broadcast Offline Status to ALL Other Connected Clients ---
-	statusMsg := StatusUpdate{
-		Type:      "status_update",
-		UserID:    req.UserID,
-		NewStatus: "offline",
-	}
-
-	// Use a goroutine to prevent blocking the HTTP response
-	go func() {
-		for _, client := range hub.Clients {
-			// Only send the status update to other users, not the one logging out
-			if client.ID != req.UserID {
-				if err := client.Conn.WriteJSON(statusMsg); err != nil {
-					log.Printf("Error broadcasting status update to user %d: %v", client.ID, err)
-					// If the write fails, assume the connection is dead and clean up
-					hub.Unregister <- client
-				}
-			}
-		}
-	}()
+	// --- START: Broadcast Offline Status ---
+	// Only to those allowed to see it, see contacts.go
+	broadcastStatus(req.UserID, "offline")
 	// --- END: Broadcast Offline Status ---
 
 	// 2. Forcibly close the WebSocket connection in the Hub
@@ -688,102 +922,356 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 //}
 
 // creating conversations
+//
+// POST /api/conversations {"participant_ids": [3], "is_group": false}
+//
+// The caller is always a participant, listed or not; IDs are deduplicated
+// and must all belong to existing users. A conversation that is not a group
+// is between the caller and exactly one other user, and there is only ever
+// one per pair: its dm_key ("smaller:larger" user ID) is UNIQUE, so when two
+// requests race, one creates it and the other gets it back with a 200.
+// Started with someone who is not a contact, it is a message request for
+// them (see contacts.go). Everything is written in one transaction and the
+// response is read back from the database.
 func createConversationHandler(w http.ResponseWriter, r *http.Request) {
+	creatorID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
 	var req createConversationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		httpError(w, http.StatusBadRequest, "invalid JSON body")
 		return
 	}
 
-	if len(req.ParticipantIDs) < 2 {
-		httpError(w, http.StatusBadRequest, "at least 2 participants required")
+	if req.IsPublic && !req.IsGroup {
+		httpError(w, http.StatusBadRequest, "only groups can be public channels")
+		return
+	}
+	if req.AnnouncementOnly && !req.IsGroup {
+		httpError(w, http.StatusBadRequest, "only groups can be announcement channels")
+		return
+	}
+	if err := validateChannelInfo(&req); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if utf8.RuneCountInString(req.Name) > maxConversationNameLength {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("name must be at most %d characters", maxConversationNameLength))
 		return
 	}
 
-	// --- START: Uniqueness Check for 1-on-1 Chats ---
-	if !req.IsGroup && len(req.ParticipantIDs) == 2 {
-		u1 := req.ParticipantIDs[0]
-		u2 := req.ParticipantIDs[1]
-
-		// Ensure u1 is the smaller ID for canonical ordering
-		if u1 > u2 {
-			u1, u2 = u2, u1
+	for _, id := range req.ParticipantIDs {
+		if id <= 0 {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("invalid participant id %d", id))
+			return
 		}
+	}
+	participantIDs := uniqueIDs(append([]int64{creatorID}, req.ParticipantIDs...))
 
-		// Find existing 1-on-1 conversation
-		var existingConvID int64
-		err := db.QueryRow(`
-            SELECT c.id FROM conversations c
-            JOIN conversation_participants cp1 ON cp1.conversation_id = c.id AND cp1.user_id = ?
-            JOIN conversation_participants cp2 ON cp2.conversation_id = c.id AND cp2.user_id = ?
-            WHERE c.is_group = 0 AND 
-                  (SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = c.id) = 2
-            LIMIT 1
-        `, u1, u2).Scan(&existingConvID)
+	// a public channel can start with only its creator, others join on their own
+	switch {
+	case !req.IsGroup && len(participantIDs) != 2:
+		httpError(w, http.StatusBadRequest, "a 1-on-1 conversation needs exactly one other participant")
+		return
+	case req.IsGroup && !req.IsPublic && len(participantIDs) < 2:
+		httpError(w, http.StatusBadRequest, "a group needs at least one other participant")
+		return
+	}
+	if missing, err := missingUserIDs(participantIDs); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	} else if len(missing) > 0 {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("user %d does not exist", missing[0]))
+		return
+	}
+	if blocked, err := blockedUserIDs(creatorID, participantIDs); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	} else if len(blocked) > 0 {
+		httpError(w, http.StatusForbidden, fmt.Sprintf("you cannot start a conversation with user %d", blocked[0]))
+		return
+	}
 
-		if err != nil && err != sql.ErrNoRows {
-			httpError(w, http.StatusInternalServerError, "db error during uniqueness check: "+err.Error())
+	var key sql.NullString
+	messageRequest := false
+	if !req.IsGroup {
+		key = sql.NullString{String: dmKey(participantIDs[0], participantIDs[1]), Valid: true}
+		if respondExistingDM(w, key.String) {
 			return
 		}
+		contacts, err := areContacts(participantIDs[0], participantIDs[1])
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+		messageRequest = !contacts
+	}
 
-		if existingConvID > 0 {
-			// Found existing conversation, retrieve and return it
-			c := conversationResponse{}
-			var name sql.NullString
-			err := db.QueryRow("SELECT id, name, is_group, created_at FROM conversations WHERE id = ?", existingConvID).
-				Scan(&c.ID, &name, &c.IsGroup, &c.CreatedAt)
-			if err == nil {
-				if name.Valid {
-					c.Name = name.String
-				}
-				c.ParticipantIDs = req.ParticipantIDs
-				respondJSON(w, http.StatusOK, map[string]any{"conversation": c, "message": "Conversation already exists"})
-				return
-			}
+	convID, created, err := insertConversation(req, creatorID, participantIDs, key, messageRequest)
+	if isDuplicateEntry(err) && key.Valid && respondExistingDM(w, key.String) {
+		return // created by a concurrent request in the meantime
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	// group_created is already stored with the group; only the live copy is left
+	if created != nil {
+		frame := *created
+		if created.announcement {
+			frame.RecipientIDs = nil
 		}
+		hub.Events <- Event{RecipientIDs: created.RecipientIDs, Payload: frame}
 	}
-	// --- END: Uniqueness Check ---
 
-	// Insert into conversations (Only runs if no existing 1-on-1 chat was found)
-	res, err := db.Exec("INSERT INTO conversations (name, is_group) VALUES (?, ?)",
-		sql.NullString{String: req.Name, Valid: req.IsGroup}, req.IsGroup)
+	conv, err := loadConversation(convID)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
 		return
 	}
+	respondJSON(w, http.StatusCreated, map[string]any{"conversation": conv})
+}
 
-	convID, _ := res.LastInsertId()
+// insertConversation creates a conversation with its participants in one
+// transaction. Whoever creates a group owns it, and the group_created system
+// message it returns is stored in the same transaction; with messageRequest,
+// it is a message request for everyone but the creator.
+func insertConversation(req createConversationRequest, creatorID int64, participantIDs []int64, key sql.NullString, messageRequest bool) (int64, *Message, error) {
+	var created *Message
+	if req.IsGroup {
+		msg := newSystemMessage(0, systemEvent{Event: systemGroupCreated, ActorID: creatorID, Name: req.Name})
+		created = &msg
+	}
 
-	// Insert participants
-	for _, uid := range req.ParticipantIDs {
-		_, _ = db.Exec("INSERT INTO conversation_participants (conversation_id, user_id) VALUES (?, ?)", convID, uid)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
 	}
+	defer tx.Rollback()
 
-	resp := conversationResponse{
-		ID:             convID,
-		Name:           req.Name,
-		IsGroup:        req.IsGroup,
-		ParticipantIDs: req.ParticipantIDs,
-		CreatedAt:      time.Now(),
+	res, err := tx.Exec(`
+		INSERT INTO conversations (name, is_group, is_public, announcement_only, topic, description, dm_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sql.NullString{String: req.Name, Valid: req.IsGroup && req.Name != ""}, req.IsGroup, req.IsPublic, req.AnnouncementOnly,
+		sql.NullString{String: req.Topic, Valid: req.Topic != ""}, sql.NullString{String: req.Description, Valid: req.Description != ""}, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	convID, err := res.LastInsertId()
+	if err != nil {
+		return 0, nil, err
 	}
 
-	respondJSON(w, http.StatusCreated, map[string]any{"conversation": resp})
+	placeholders := make([]string, len(participantIDs))
+	args := make([]any, 0, 4*len(participantIDs))
+	for i, uid := range participantIDs {
+		role := roleMember
+		if req.IsGroup && uid == creatorID {
+			role = roleOwner
+		}
+		request := sql.NullString{String: "pending", Valid: messageRequest && uid != creatorID}
+		placeholders[i] = "(?, ?, ?, ?)"
+		args = append(args, convID, uid, role, request)
+	}
+	if _, err := tx.Exec("INSERT INTO conversation_participants (conversation_id, user_id, role, message_request) VALUES "+strings.Join(placeholders, ", "), args...); err != nil {
+		return 0, nil, err
+	}
+	if created == nil {
+		return convID, nil, tx.Commit()
+	}
+
+	created.ConversationID = convID
+	msgID, seq, createdAt, err := insertMessageTx(tx, created)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	loc, _ := time.LoadLocation("Africa/Nairobi")
+	created.ID, created.Seq, created.CreatedAt = msgID, seq, createdAt.In(loc).Format(time.RFC3339)
+	created.RecipientIDs, created.announcement = participantIDs, req.AnnouncementOnly
+	if !created.announcement {
+		if err := recordMessageStatus(msgID, convID); err != nil {
+			log.Printf("Failed to record status of message %d: %v", msgID, err)
+		}
+	}
+	return convID, created, nil
+}
+
+// respondExistingDM answers with the 1-on-1 conversation for key, if there is one.
+func respondExistingDM(w http.ResponseWriter, key string) bool {
+	var convID int64
+	err := db.QueryRow("SELECT id FROM conversations WHERE dm_key = ?", key).Scan(&convID)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return true
+	}
+	conv, err := loadConversation(convID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return true
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"conversation": conv, "message": "Conversation already exists"})
+	return true
+}
+
+// dmKey identifies the 1-on-1 conversation between two users.
+func dmKey(a, b int64) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
+
+// missingUserIDs returns the IDs that belong to no user.
+func missingUserIDs(ids []int64) ([]int64, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query("SELECT id FROM users WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	var missing []int64
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing, rows.Err()
 }
 
 // listing conversation
+//
+// GET /api/conversations?user_id=N[&archived=true|all][&muted=][&pinned=][&unread=][&requests=true][&folder_id=]
+//
+// requests=true lists the message requests inbox instead (see contacts.go);
+// folder_id keeps the conversations in one of the user's folders (see folders.go).
+// Archived conversations are left out unless archived= asks for them; muted,
+// pinned and unread take true or false, where unread also covers
+// conversations marked unread. Pinned conversations come first in their pin
+// order, the rest by latest activity. See settings.go for the per-user flags.
 func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
 	// For simplicity, take user_id as query param for now
-	userID := r.URL.Query().Get("user_id")
+	q := r.URL.Query()
+	userID := q.Get("user_id")
 	if userID == "" {
 		httpError(w, http.StatusBadRequest, "user_id required")
 		return
 	}
 
-	rows, err := db.Query(`
-		SELECT c.id, c.name, c.is_group
+	where := []string{"cp.user_id = ?"}
+	args := []any{userID}
+	switch q.Get("requests") {
+	case "", "false":
+		where = append(where, "cp.message_request IS NULL")
+	case "true":
+		where = append(where, "cp.message_request = 'pending'")
+	default:
+		httpError(w, http.StatusBadRequest, "requests must be true or false")
+		return
+	}
+	var having []string
+	switch q.Get("archived") {
+	case "", "false":
+		where = append(where, "cp.archived = 0")
+	case "true":
+		where = append(where, "cp.archived = 1")
+	case "all":
+	default:
+		httpError(w, http.StatusBadRequest, "archived must be true, false or all")
+		return
+	}
+	filters := []struct {
+		param       string
+		onTrue      string
+		onFalse     string
+		onAggregate bool
+	}{
+		{"muted", "cp.muted_until > NOW()", "(cp.muted_until IS NULL OR cp.muted_until <= NOW())", false},
+		{"pinned", "cp.pinned_order IS NOT NULL", "cp.pinned_order IS NULL", false},
+		{"unread", "(unread_count > 0 OR marked_unread = 1)", "(unread_count = 0 AND marked_unread = 0)", true},
+	}
+	if v := q.Get("folder_id"); v != "" {
+		folderID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid folder_id")
+			return
+		}
+		uid, _ := strconv.ParseInt(userID, 10, 64)
+		folderWhere, folderArgs, folderHaving, err := folderClauses(folderID, uid)
+		if err != nil {
+			folderError(w, err)
+			return
+		}
+		where, args = append(where, folderWhere...), append(args, folderArgs...)
+		having = append(having, folderHaving...)
+	}
+	for _, f := range filters {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, f.param+" must be true or false")
+			return
+		}
+		clause := f.onFalse
+		if b {
+			clause = f.onTrue
+		}
+		if f.onAggregate {
+			having = append(having, clause)
+		} else {
+			where = append(where, clause)
+		}
+	}
+
+	// unread counters, mentions are counted on their own; system messages never count
+	query := `
+		SELECT c.id, c.name, c.is_group, c.is_public, c.announcement_only, COALESCE(c.message_ttl, 0), c.ttl_mode, COALESCE(c.topic, ''), COALESCE(c.description, ''),
+		       IF(cp.muted_until > NOW(), cp.muted_until, NULL), cp.archived, cp.pinned_order, cp.marked_unread AS marked_unread,
+		       (SELECT COUNT(*) FROM messages m
+		        WHERE m.conversation_id = c.id AND m.sender_id <> cp.user_id
+		          AND m.seq > cp.last_read_seq AND m.message_type <> 'system' AND ` + notExpired + `) AS unread_count,
+		       (SELECT COUNT(*) FROM message_mentions mm
+		        JOIN messages m ON m.id = mm.message_id
+		        WHERE mm.conversation_id = c.id AND mm.user_id = cp.user_id
+		          AND m.seq > cp.last_read_seq) AS unread_mention_count,
+		       COALESCE((SELECT MAX(m.created_at) FROM messages m WHERE m.conversation_id = c.id), c.created_at) AS last_activity_at
 		FROM conversations c
 		JOIN conversation_participants cp ON cp.conversation_id = c.id
-		WHERE cp.user_id = ?`, userID)
+		WHERE ` + strings.Join(where, " AND ")
+	if len(having) > 0 {
+		query += " HAVING " + strings.Join(having, " AND ")
+	}
+	query += " ORDER BY cp.pinned_order IS NULL, cp.pinned_order, last_activity_at DESC, c.id DESC"
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
 		return
@@ -792,9 +1280,11 @@ func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
 
 	convs := []conversationResponse{}
 	for rows.Next() {
-		var c conversationResponse
+		c := conversationResponse{participantSettings: &participantSettings{}}
 		var name sql.NullString
-		if err := rows.Scan(&c.ID, &name, &c.IsGroup); err != nil {
+		if err := rows.Scan(&c.ID, &name, &c.IsGroup, &c.IsPublic, &c.AnnouncementOnly, &c.MessageTTL, &c.TTLMode, &c.Topic, &c.Description,
+			&c.MutedUntil, &c.Archived, &c.PinOrder, &c.MarkedUnread,
+			&c.UnreadCount, &c.UnreadMentionCount, &c.LastActivityAt); err != nil {
 			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
 			return
 		}
@@ -803,6 +1293,7 @@ func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			c.Name = ""
 		}
+		c.Pinned = c.PinOrder != nil
 
 		// fetch participant ids
 		pRows, _ := db.Query("SELECT user_id FROM conversation_participants WHERE conversation_id = ?", c.ID)
@@ -821,6 +1312,111 @@ func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]any{"conversations": convs})
 }
 
+// marking a conversation as read
+//
+// POST /api/conversations/{id}/read {"message_id": N}
+// Moves the caller's read pointer forward to N (or to the latest message when
+// message_id is omitted) and flags the covered message_status rows as read.
+// The pointer is kept both as a message ID and as a seq, which the unread
+// counters go by. It never moves backwards.
+func markConversationReadHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	convID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	var req struct {
+		MessageID int64 `json:"message_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+	if req.MessageID == 0 {
+		db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM messages WHERE conversation_id = ?", convID).Scan(&req.MessageID)
+	}
+	var seq int64
+	if req.MessageID > 0 {
+		seq, err = messageSeq(convID, req.MessageID)
+		if err == sql.ErrNoRows {
+			httpError(w, http.StatusNotFound, "message not found in this conversation")
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+
+	res, err := db.Exec(`
+		UPDATE conversation_participants
+		SET last_read_message_id = GREATEST(COALESCE(last_read_message_id, 0), ?),
+		    last_read_seq = GREATEST(last_read_seq, ?),
+		    marked_unread = 0
+		WHERE conversation_id = ? AND user_id = ?`, req.MessageID, seq, convID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// either not a participant or nothing changed; tell them apart
+		var one int
+		if err := db.QueryRow("SELECT 1 FROM conversation_participants WHERE conversation_id = ? AND user_id = ?", convID, userID).Scan(&one); err != nil {
+			httpError(w, http.StatusForbidden, errNotParticipant.Error())
+			return
+		}
+	}
+
+	_, err = db.Exec(`
+		UPDATE message_status ms
+		JOIN messages m ON m.id = ms.message_id
+		SET ms.status = 'read', ms.status_at = NOW()
+		WHERE ms.user_id = ? AND ms.status <> 'read' AND m.conversation_id = ? AND m.seq <= ?`,
+		userID, convID, seq)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	// read-mode disappearing messages start their countdown now
+	if err := startReadTTL(convID, userID, seq); err != nil {
+		log.Printf("Failed to start read TTL in conversation %d: %v", convID, err)
+	}
+
+	// announcement channels do not push read receipts to their whole audience,
+	// and the sender of a message request gets none (see contacts.go)
+	announcement, err := isAnnouncementOnly(convID)
+	if err != nil {
+		log.Printf("Failed to load conversation %d: %v", convID, err)
+	}
+	request, err := hasMessageRequest(convID, userID)
+	if err != nil {
+		log.Printf("Failed to load message request in conversation %d: %v", convID, err)
+	}
+	if participantIDs, err := conversationParticipantIDs(convID); err == nil && !announcement && !request {
+		hub.Events <- Event{
+			RecipientIDs: participantIDs,
+			Payload: ReadReceiptEvent{
+				Type:              "read_receipt",
+				ConversationID:    convID,
+				UserID:            userID,
+				LastReadMessageID: req.MessageID,
+				LastReadSeq:       seq,
+			},
+		}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{"conversation_id": convID, "last_read_message_id": req.MessageID, "last_read_seq": seq})
+}
+
 // sending messages
 func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	var req sendMessageRequest
@@ -829,72 +1425,282 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateClientMsgID(req.ClientMsgID); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if name, args, ok := parseCommand(req.MessageType, &req.Content); ok {
+		respondCommand(w, r, req, name, args)
+		return
+	}
+
+	if err := validateMessageBody(req.ConversationID, &req.MessageType, &req.Content, &req.richPayload); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.SendAt != nil && req.SendAt.After(time.Now()) {
+		scheduleMessage(w, req)
+		return
+	}
+	if err := checkCanPost(req.ConversationID, req.SenderID); err != nil {
+		participantError(w, err)
+		return
+	}
+	// A retry returns what was stored the first time
+	if req.ClientMsgID != "" {
+		if respondStoredClientMessage(w, req.SenderID, req.ClientMsgID) {
+			return
+		}
+	}
+
 	// insert message
-	res, err := db.Exec("INSERT INTO messages (conversation_id, sender_id, content, message_type) VALUES (?, ?, ?, ?)",
-		req.ConversationID, req.SenderID, req.Content, req.MessageType)
+	msg := Message{
+		ConversationID: req.ConversationID,
+		SenderID:       req.SenderID,
+		Content:        req.Content,
+		MessageType:    req.MessageType,
+		ClientMsgID:    req.ClientMsgID,
+		richPayload:    req.richPayload,
+	}
+	msgID, seq, createdAt, err := insertMessage(&msg)
 	if err != nil {
+		if isDuplicateEntry(err) && req.ClientMsgID != "" && respondStoredClientMessage(w, req.SenderID, req.ClientMsgID) {
+			return
+		}
 		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
 		return
 	}
-	msgID, _ := res.LastInsertId()
 
-	// get participants
-	rows, _ := db.Query("SELECT user_id, status FROM conversation_participants cp JOIN users u ON cp.user_id = u.id WHERE conversation_id = ?", req.ConversationID)
-	for rows.Next() {
-		var uid int64
-		var status string
-		rows.Scan(&uid, &status)
+	expiresAt, err := applyMessageTTL(msgID)
+	if err != nil {
+		log.Printf("Failed to apply TTL to message %d: %v", msgID, err)
+	}
+	if err := unarchiveOnMessage(req.ConversationID); err != nil {
+		log.Printf("Failed to unarchive conversation %d: %v", req.ConversationID, err)
+	}
 
-		msgStatus := "sent"
-		if status == "online" {
-			msgStatus = "delivered"
+	// status rows for the participants, except in announcement channels
+	if announcement, err := isAnnouncementOnly(req.ConversationID); err == nil && !announcement {
+		if err := recordMessageStatus(msgID, req.ConversationID); err != nil {
+			log.Printf("Failed to record status of message %d: %v", msgID, err)
 		}
+	}
 
-		db.Exec("INSERT INTO message_status (message_id, user_id, status) VALUES (?, ?, ?)", msgID, uid, msgStatus)
+	mentions, mentioned, err := saveMentions(msgID, req.ConversationID, req.SenderID, msg.Text)
+	if err != nil {
+		log.Printf("Failed to save mentions for message %d: %v", msgID, err)
+	}
+	for _, event := range mentionEvents(msgID, req.ConversationID, req.SenderID, msg.Text, mentioned) {
+		hub.Events <- event
 	}
-	rows.Close()
 
 	resp := messageResponse{
 		ID:             msgID,
 		ConversationID: req.ConversationID,
+		Seq:            seq,
 		SenderID:       req.SenderID,
 		Content:        req.Content,
+		Text:           msg.Text,
+		Entities:       msg.Entities,
 		MessageType:    req.MessageType,
-		CreatedAt:      time.Now(),
+		Mentions:       mentions,
+		ExpiresAt:      expiresAt,
+		ClientMsgID:    req.ClientMsgID,
+		CreatedAt:      createdAt,
+		richPayload:    req.richPayload,
 	}
 
 	respondJSON(w, http.StatusCreated, map[string]any{"message": resp})
 }
 
 // fetching messages
+//
+// Messages come back oldest first, one page at a time, ordered by seq:
+//
+//	?conversation_id=N                 newest page
+//	?conversation_id=N&before=SEQ      page of messages older than SEQ
+//	?conversation_id=N&after=SEQ       page of messages newer than SEQ
+//	?conversation_id=N&around_id=ID    page centred on message ID (jump to a search hit or reply)
+//
+// Only participants can read a conversation's messages.
+//
+// limit defaults to defaultMessagePageSize and is capped at maxMessagePageSize.
+// next_cursor is the value to pass as before= (or after= when paging forward)
+// to get the following page; it is null when has_more is false.
 func listMessagesHandler(w http.ResponseWriter, r *http.Request) {
-	convID := r.URL.Query().Get("conversation_id")
-	if convID == "" {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	convID, err := strconv.ParseInt(q.Get("conversation_id"), 10, 64)
+	if err != nil || convID <= 0 {
 		httpError(w, http.StatusBadRequest, "conversation_id required")
 		return
 	}
+	if _, _, err := participantRole(convID, userID); err != nil {
+		participantError(w, err)
+		return
+	}
+
+	limit := defaultMessagePageSize
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxMessagePageSize {
+			limit = maxMessagePageSize
+		}
+	}
+
+	cursors := 0
+	var before, after, around int64
+	for name, dst := range map[string]*int64{"before": &before, "after": &after, "around_id": &around} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		cursors++
+		if *dst, err = strconv.ParseInt(v, 10, 64); err != nil || *dst <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid "+name+" cursor")
+			return
+		}
+	}
+	if cursors > 1 {
+		httpError(w, http.StatusBadRequest, "use only one of before, after or around_id")
+		return
+	}
 
-	rows, err := db.Query("SELECT id, conversation_id, sender_id, content, message_type, created_at FROM messages WHERE conversation_id=? ORDER BY created_at ASC", convID)
+	var page messagePage
+	switch {
+	case after > 0:
+		page, err = messagesAfter(convID, userID, after, limit)
+	case around > 0:
+		page, err = messagesAround(convID, userID, around, limit)
+	default:
+		page, err = messagesBefore(convID, userID, before, limit)
+	}
+	if err == sql.ErrNoRows {
+		httpError(w, http.StatusNotFound, "message not found in this conversation")
+		return
+	}
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
 		return
 	}
+
+	respondJSON(w, http.StatusOK, page)
+}
+
+// ==== helpers ====
+
+// currentUserID identifies the caller from the Bearer token issued by
+// loginHandler, falling back to the user_id query parameter (for testing
+// convenience, like the other handlers).
+func currentUserID(r *http.Request) (int64, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, func(*jwt.Token) (any, error) {
+			return jwtKey, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		if err == nil {
+			if uid, ok := claims["user_id"].(float64); ok && uid > 0 {
+				return int64(uid), nil
+			}
+		}
+	}
+
+	userID, err := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, errors.New("authentication required: send a Bearer token or user_id")
+	}
+	return userID, nil
+}
+
+// participantRole returns the user's role in a conversation and whether it
+// is a group, or errNotParticipant.
+func participantRole(convID, userID int64) (string, bool, error) {
+	var role string
+	var isGroup bool
+	err := db.QueryRow(`
+		SELECT cp.role, c.is_group
+		FROM conversation_participants cp
+		JOIN conversations c ON c.id = cp.conversation_id
+		WHERE cp.conversation_id = ? AND cp.user_id = ?`, convID, userID).Scan(&role, &isGroup)
+	if err == sql.ErrNoRows {
+		return "", false, errNotParticipant
+	}
+	return role, isGroup, err
+}
+
+// participantError maps an error from participantRole to a response.
+func participantError(w http.ResponseWriter, err error) {
+	if err == errNotParticipant || err == errAnnouncementOnly {
+		httpError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+}
+
+// messageConversationID returns the conversation a message belongs to.
+func messageConversationID(msgID int64) (int64, error) {
+	var convID int64
+	err := db.QueryRow("SELECT conversation_id FROM messages WHERE id = ?", msgID).Scan(&convID)
+	return convID, err
+}
+
+func usernameByID(userID int64) string {
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return fmt.Sprintf("user %d", userID)
+	}
+	return username
+}
+
+// uniqueIDs drops duplicates and non-positive IDs, keeping the first-seen order.
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	out := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if id > 0 && !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// truncateRunes shortens s to at most n runes, adding an ellipsis when cut.
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
+
+// conversationParticipantIDs returns the user IDs taking part in a conversation.
+func conversationParticipantIDs(convID int64) ([]int64, error) {
+	rows, err := db.Query("SELECT user_id FROM conversation_participants WHERE conversation_id = ?", convID)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	msgs := []messageResponse{}
+	var ids []int64
 	for rows.Next() {
-		var m messageResponse
-		if err := rows.Scan(&m.ID, &m.ConversationID, &m.SenderID, &m.Content, &m.MessageType, &m.CreatedAt); err != nil {
-			httpError(w, http.StatusInternalServerError, err.Error())
-			return
+		var uid int64
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
 		}
-		msgs = append(msgs, m)
+		ids = append(ids, uid)
 	}
-
-	respondJSON(w, http.StatusOK, map[string]any{"messages": msgs})
+	return ids, rows.Err()
 }
 
-// ==== helpers ====
 func httpError(w http.ResponseWriter, status int, msg string) {
 	respondJSON(w, status, map[string]string{"error": msg})
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDMKey(t *testing.T) {
+	if got := dmKey(7, 3); got != "3:7" {
+		t.Errorf("dmKey(7, 3) = %q, want 3:7", got)
+	}
+	if dmKey(3, 7) != dmKey(7, 3) {
+		t.Error("dmKey depends on argument order")
+	}
+	if dmKey(1, 23) == dmKey(12, 3) {
+		t.Error("dmKey(1, 23) collides with dmKey(12, 3)")
+	}
+}
+
+func TestUniqueIDs(t *testing.T) {
+	tests := []struct {
+		in, want []int64
+	}{
+		{nil, []int64{}},
+		{[]int64{3, 1, 3, 2, 1}, []int64{3, 1, 2}},
+		{[]int64{0, -4, 5}, []int64{5}},
+	}
+	for _, tt := range tests {
+		if got := uniqueIDs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("uniqueIDs(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateClientMsgID(t *testing.T) {
+	for _, id := range []string{"", "abc-123", "schedule:1"} {
+		if err := validateClientMsgID(id); err != nil {
+			t.Errorf("validateClientMsgID(%q) = %v, want nil", id, err)
+		}
+	}
+	long := make([]byte, maxClientMsgIDLength+1)
+	for i := range long {
+		long[i] = 'x'
+	}
+	for _, id := range []string{string(long), "scheduled:42"} {
+		if err := validateClientMsgID(id); err == nil {
+			t.Errorf("validateClientMsgID(%q) succeeded, want an error", id)
+		}
+	}
+}
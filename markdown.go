@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ==== Markdown entities ====
+//
+// Text messages may use a small, safe Markdown subset:
+//
+//	**bold**  *italic* or _italic_  `code`  [label](https://...)
+//	```go            code block with an optional language
+//	...
+//	```
+//	> quote
+//
+// The server strips the markers into a plain-text projection (messages.plain_text,
+// "text" in responses) and records what they meant as entities over that text
+// (messages.entities). Offsets and lengths are in UTF-16 code units like the
+// mention entities, which are parsed from the same plain text. Clients render
+// text + entities, search and previews use the text alone, and content keeps
+// what the sender typed. Nothing is ever turned into HTML on the server, and
+// links are limited to http, https and mailto. A backslash escapes a marker.
+
+const (
+	entityBold   = "bold"
+	entityItalic = "italic"
+	entityCode   = "code"
+	entityPre    = "pre"
+	entityLink   = "link"
+	entityQuote  = "quote"
+)
+
+type textEntity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url,omitempty"`      // link
+	Language string `json:"language,omitempty"` // pre
+}
+
+// entityBuilder accumulates the plain text and tracks its UTF-16 length.
+type entityBuilder struct {
+	text     strings.Builder
+	off      int
+	entities []textEntity
+}
+
+func (b *entityBuilder) write(s string) {
+	b.text.WriteString(s)
+	b.off += utf16Len(s)
+}
+
+func (b *entityBuilder) add(typ string, start int, e textEntity) {
+	if b.off == start {
+		return // nothing inside the markers
+	}
+	e.Type, e.Offset, e.Length = typ, start, b.off-start
+	b.entities = append(b.entities, e)
+}
+
+// parseMarkdown returns the plain-text projection of content and its entities.
+// Only text messages are parsed; other types return content unchanged.
+func parseMarkdown(messageType, content string) (string, []textEntity) {
+	if messageType != "text" {
+		return content, nil
+	}
+
+	var b entityBuilder
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		if i > 0 {
+			b.write("\n")
+		}
+		line := lines[i]
+
+		// ``` fenced code block, taken verbatim up to the closing fence
+		if lang, ok := strings.CutPrefix(line, "```"); ok {
+			end := -1
+			for j := i + 1; j < len(lines); j++ {
+				if strings.TrimSpace(lines[j]) == "```" {
+					end = j
+					break
+				}
+			}
+			if end > 0 {
+				start := b.off
+				b.write(strings.Join(lines[i+1:end], "\n"))
+				b.add(entityPre, start, textEntity{Language: strings.TrimSpace(lang)})
+				i = end
+				continue
+			}
+		}
+
+		// > quote, merged with the quote lines that follow
+		if isQuoteLine(line) {
+			start := b.off
+			for {
+				parseInline(&b, strings.TrimPrefix(strings.TrimPrefix(lines[i], ">"), " "))
+				if i+1 >= len(lines) || !isQuoteLine(lines[i+1]) {
+					break
+				}
+				i++
+				b.write("\n")
+			}
+			b.add(entityQuote, start, textEntity{})
+			continue
+		}
+
+		parseInline(&b, line)
+	}
+
+	entities := b.entities
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].Offset != entities[j].Offset {
+			return entities[i].Offset < entities[j].Offset
+		}
+		return entities[i].Length > entities[j].Length // outer before inner
+	})
+	return b.text.String(), entities
+}
+
+// escapeMarkdown backslash-escapes the markers in s, so it comes out of
+// parseMarkdown as typed.
+func escapeMarkdown(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("\\`*_[]()>", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isQuoteLine(line string) bool {
+	return strings.HasPrefix(line, ">")
+}
+
+// parseInline handles the span-level markers of one line.
+func parseInline(b *entityBuilder, s string) {
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()>", s[i+1]) >= 0:
+			b.write(s[i+1 : i+2])
+			i += 2
+			continue
+
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > 0 {
+				start := b.off
+				b.write(s[i+1 : i+1+end])
+				b.add(entityCode, start, textEntity{})
+				i += end + 2
+				continue
+			}
+
+		case c == '*' && strings.HasPrefix(s[i:], "**"):
+			if end := strings.Index(s[i+2:], "**"); end > 0 {
+				start := b.off
+				parseInline(b, s[i+2:i+2+end])
+				b.add(entityBold, start, textEntity{})
+				i += end + 4
+				continue
+			}
+
+		case c == '*' || c == '_':
+			if end := closingEmphasis(s, i); end > 0 {
+				start := b.off
+				parseInline(b, s[i+1:end])
+				b.add(entityItalic, start, textEntity{})
+				i = end + 1
+				continue
+			}
+
+		case c == '[':
+			if label, url, n, ok := parseLink(s[i:]); ok {
+				start := b.off
+				parseInline(b, label)
+				b.add(entityLink, start, textEntity{URL: url})
+				i += n
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		b.write(s[i : i+size])
+		i += size
+	}
+}
+
+// closingEmphasis finds the marker closing the single * or _ at s[i], or -1.
+// Like most chat apps it ignores markers inside words (snake_case, 2*3*4).
+func closingEmphasis(s string, i int) int {
+	marker := s[i]
+	if i > 0 {
+		if prev, _ := utf8.DecodeLastRuneInString(s[:i]); isWordRune(prev) {
+			return -1
+		}
+	}
+	if next, _ := utf8.DecodeRuneInString(s[i+1:]); next == utf8.RuneError || unicode.IsSpace(next) {
+		return -1
+	}
+	for j := i + 2; j < len(s); j++ {
+		if s[j] != marker || s[j-1] == '\\' {
+			continue
+		}
+		if prev, _ := utf8.DecodeLastRuneInString(s[:j]); unicode.IsSpace(prev) {
+			continue
+		}
+		if next, _ := utf8.DecodeRuneInString(s[j+1:]); next != utf8.RuneError && isWordRune(next) {
+			continue
+		}
+		if marker == '*' && j+1 < len(s) && s[j+1] == '*' {
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// parseLink reads [label](url) at the start of s and returns the number of
+// bytes it spans. Only http, https and mailto targets are accepted.
+func parseLink(s string) (label, url string, n int, ok bool) {
+	closeLabel := strings.Index(s, "](")
+	if closeLabel <= 1 {
+		return "", "", 0, false
+	}
+	closeURL := strings.IndexByte(s[closeLabel+2:], ')')
+	if closeURL <= 0 {
+		return "", "", 0, false
+	}
+	label = s[1:closeLabel]
+	url = strings.TrimSpace(s[closeLabel+2 : closeLabel+2+closeURL])
+	if strings.ContainsAny(label, "[]") || strings.ContainsAny(url, " \t<>\"") {
+		return "", "", 0, false
+	}
+	lower := strings.ToLower(url)
+	if !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "mailto:") {
+		return "", "", 0, false
+	}
+	return label, url, closeLabel + 2 + closeURL + 1, true
+}
+
+// decodeEntities reads messages.entities.
+func decodeEntities(raw sql.NullString) []textEntity {
+	if !raw.Valid {
+		return nil
+	}
+	var entities []textEntity
+	json.Unmarshal([]byte(raw.String), &entities)
+	return entities
+}
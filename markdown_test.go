@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      string
+		content  string
+		text     string
+		entities []textEntity
+	}{
+		{"plain", "text", "hello there", "hello there", nil},
+		{"bold and italic", "text", "**bold** and *it*", "bold and it", []textEntity{
+			{Type: entityBold, Offset: 0, Length: 4},
+			{Type: entityItalic, Offset: 9, Length: 2},
+		}},
+		{"nested", "text", "**a *b* c**", "a b c", []textEntity{
+			{Type: entityBold, Offset: 0, Length: 5},
+			{Type: entityItalic, Offset: 2, Length: 1},
+		}},
+		{"underscores inside words", "text", "snake_case_name", "snake_case_name", nil},
+		{"code keeps markers", "text", "`a*b*`", "a*b*", []textEntity{
+			{Type: entityCode, Offset: 0, Length: 4},
+		}},
+		{"link", "text", "see [site](https://x.io)", "see site", []textEntity{
+			{Type: entityLink, Offset: 4, Length: 4, URL: "https://x.io"},
+		}},
+		{"unsafe link scheme", "text", "[x](javascript:alert)", "[x](javascript:alert)", nil},
+		{"quote", "text", "> quoted\n> more\nafter", "quoted\nmore\nafter", []textEntity{
+			{Type: entityQuote, Offset: 0, Length: 11},
+		}},
+		{"code block", "text", "```go\nx := 1\n```", "x := 1", []textEntity{
+			{Type: entityPre, Offset: 0, Length: 6, Language: "go"},
+		}},
+		{"escaped markers", "text", `\*not\*`, "*not*", nil},
+		{"utf-16 offsets", "text", "😀 **hi**", "😀 hi", []textEntity{
+			{Type: entityBold, Offset: 3, Length: 2},
+		}},
+		{"other types untouched", "image", "**x**", "**x**", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, entities := parseMarkdown(tt.typ, tt.content)
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if !reflect.DeepEqual(entities, tt.entities) {
+				t.Errorf("entities = %+v, want %+v", entities, tt.entities)
+			}
+		})
+	}
+}
+
+func TestEscapeMarkdownRoundTrip(t *testing.T) {
+	for _, s := range []string{"alice *waves*", "a_b [c](d) `e` > f", `back\slash`} {
+		text, entities := parseMarkdown("text", escapeMarkdown(s))
+		if text != s || len(entities) != 0 {
+			t.Errorf("parseMarkdown(escapeMarkdown(%q)) = %q, %+v", s, text, entities)
+		}
+	}
+}
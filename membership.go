@@ -0,0 +1,447 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Group membership ====
+//
+//	POST   /api/conversations/{id}/participants {"user_ids": [4, 5]}   owners and admins
+//	DELETE /api/conversations/{id}/participants/{user_id}               owners and admins
+//	POST   /api/conversations/{id}/leave                                 any member
+//	PATCH  /api/conversations/{id} {"name": "...", "description": "..."} owners and admins
+//	       also "topic", "is_public" (channels.go) and "announcement_only" (announcements.go)
+//
+// Only groups can be changed this way. Admins can remove members but not
+// other admins or the owner; the owner can remove anyone. When the owner
+// leaves, the longest-standing admin (or else member) becomes the owner.
+// Every change is recorded with a system message and pushed to the members,
+// and to whoever was removed, as a conversation_updated event carrying the
+// new state of the conversation. The /invite and /leave commands go through
+// the same functions.
+//
+// Recipients are looked up when a message is saved, so a member who leaves
+// stops getting messages at once, and can no longer post.
+
+const (
+	maxConversationNameLength = 100
+	maxDescriptionLength      = 500
+)
+
+// ConversationUpdatedEvent tells clients to refresh a conversation.
+type ConversationUpdatedEvent struct {
+	Type         string               `json:"type"`   // "conversation_updated"
+	Change       string               `json:"change"` // the system event, see system.go
+	ActorID      int64                `json:"actor_id"`
+	UserIDs      []int64              `json:"user_ids,omitempty"` // members added or removed
+	Conversation conversationResponse `json:"conversation"`
+}
+
+// POST /api/conversations/{id}/participants {"user_ids": [4, 5]}
+func addParticipantsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := groupAdminRequest(w, r, "add participants")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		UserIDs []int64 `json:"user_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	ids := uniqueIDs(req.UserIDs)
+	if len(ids) == 0 {
+		httpError(w, http.StatusBadRequest, "user_ids required")
+		return
+	}
+	if missing, err := missingUserIDs(ids); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	} else if len(missing) > 0 {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("user %d does not exist", missing[0]))
+		return
+	}
+	if blocked, err := blockedUserIDs(userID, ids); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	} else if len(blocked) > 0 {
+		httpError(w, http.StatusForbidden, fmt.Sprintf("you cannot add user %d", blocked[0]))
+		return
+	}
+
+	added, err := inviteParticipants(convID, userID, ids)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondConversation(w, convID, map[string]any{"added_user_ids": added})
+}
+
+// DELETE /api/conversations/{id}/participants/{user_id}
+func removeParticipantHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := groupAdminRequest(w, r, "remove participants")
+	if !ok {
+		return
+	}
+	targetID, err := strconv.ParseInt(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	if targetID == userID {
+		httpError(w, http.StatusBadRequest, "use POST /api/conversations/{id}/leave to leave a group")
+		return
+	}
+
+	actorRole, _, _ := participantRole(convID, userID)
+	targetRole, _, err := participantRole(convID, targetID)
+	if err == errNotParticipant {
+		httpError(w, http.StatusNotFound, "user is not a participant of this conversation")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if targetRole == roleOwner || (targetRole == roleAdmin && actorRole != roleOwner) {
+		httpError(w, http.StatusForbidden, "admins can only be removed by the group owner")
+		return
+	}
+
+	if err := dropParticipant(convID, userID, targetID); err != nil {
+		participantError(w, err)
+		return
+	}
+	respondConversation(w, convID, map[string]any{"removed_user_id": targetID})
+}
+
+// POST /api/conversations/{id}/leave
+func leaveConversationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := conversationRequest(w, r)
+	if !ok {
+		return
+	}
+	_, isGroup, err := participantRole(convID, userID)
+	if err != nil {
+		participantError(w, err)
+		return
+	}
+	if !isGroup {
+		httpError(w, http.StatusBadRequest, "you can only leave groups")
+		return
+	}
+
+	if err := dropParticipant(convID, userID, userID); err != nil {
+		participantError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"conversation_id": convID, "left": true})
+}
+
+// PATCH /api/conversations/{id} {"name": "...", "description": "...", "topic": "...", "is_public": true, "announcement_only": true}
+//
+// Any field may be left out; an empty description or topic clears it.
+func updateConversationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := groupAdminRequest(w, r, "edit the group")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name             *string `json:"name"`
+		Description      *string `json:"description"`
+		Topic            *string `json:"topic"`
+		IsPublic         *bool   `json:"is_public"`
+		AnnouncementOnly *bool   `json:"announcement_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Name == nil && req.Description == nil && req.Topic == nil && req.IsPublic == nil && req.AnnouncementOnly == nil {
+		httpError(w, http.StatusBadRequest, "nothing to update: send name, description, topic, is_public or announcement_only")
+		return
+	}
+	if req.Name != nil {
+		*req.Name = strings.TrimSpace(*req.Name)
+		if *req.Name == "" || utf8.RuneCountInString(*req.Name) > maxConversationNameLength {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("name must be 1 to %d characters", maxConversationNameLength))
+			return
+		}
+	}
+	if req.Description != nil {
+		*req.Description = strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(*req.Description) > maxDescriptionLength {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("description must be at most %d characters", maxDescriptionLength))
+			return
+		}
+	}
+	if req.Topic != nil {
+		*req.Topic = strings.TrimSpace(*req.Topic)
+		if utf8.RuneCountInString(*req.Topic) > maxTopicLength {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("topic must be at most %d characters", maxTopicLength))
+			return
+		}
+	}
+
+	if req.Name != nil {
+		if _, err := db.Exec("UPDATE conversations SET name = ? WHERE id = ?", *req.Name, convID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+		announceChange(convID, systemEvent{Event: systemRenamed, ActorID: userID, Name: *req.Name})
+	}
+	if req.Description != nil {
+		description := sql.NullString{String: *req.Description, Valid: *req.Description != ""}
+		if _, err := db.Exec("UPDATE conversations SET description = ? WHERE id = ?", description, convID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+		announceChange(convID, systemEvent{Event: systemDescriptionChanged, ActorID: userID, Description: description.String})
+	}
+	if req.Topic != nil {
+		topic := sql.NullString{String: *req.Topic, Valid: *req.Topic != ""}
+		if _, err := db.Exec("UPDATE conversations SET topic = ? WHERE id = ?", topic, convID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+		announceChange(convID, systemEvent{Event: systemTopicChanged, ActorID: userID, Topic: topic.String})
+	}
+	if req.IsPublic != nil {
+		res, err := db.Exec("UPDATE conversations SET is_public = ? WHERE id = ? AND is_public <> ?", *req.IsPublic, convID, *req.IsPublic)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			event := systemMadePrivate
+			if *req.IsPublic {
+				event = systemMadePublic
+			}
+			announceChange(convID, systemEvent{Event: event, ActorID: userID})
+		}
+	}
+	if req.AnnouncementOnly != nil {
+		res, err := db.Exec("UPDATE conversations SET announcement_only = ? WHERE id = ? AND announcement_only <> ?", *req.AnnouncementOnly, convID, *req.AnnouncementOnly)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			event := systemEveryoneCanPost
+			if *req.AnnouncementOnly {
+				event = systemAdminsOnlyPosting
+			}
+			announceChange(convID, systemEvent{Event: event, ActorID: userID})
+		}
+	}
+
+	respondConversation(w, convID, nil)
+}
+
+// conversationRequest reads the caller and the {id} path parameter.
+func conversationRequest(w http.ResponseWriter, r *http.Request) (userID, convID int64, ok bool) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return 0, 0, false
+	}
+	convID, err = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid conversation id")
+		return 0, 0, false
+	}
+	return userID, convID, true
+}
+
+// groupAdminRequest is conversationRequest for actions reserved to the owner
+// and admins of a group; action completes "only group admins can ...".
+func groupAdminRequest(w http.ResponseWriter, r *http.Request, action string) (userID, convID int64, ok bool) {
+	userID, convID, ok = conversationRequest(w, r)
+	if !ok {
+		return 0, 0, false
+	}
+	role, isGroup, err := participantRole(convID, userID)
+	if err != nil {
+		participantError(w, err)
+		return 0, 0, false
+	}
+	if !isGroup {
+		httpError(w, http.StatusBadRequest, "only groups can be changed")
+		return 0, 0, false
+	}
+	if role != roleOwner && role != roleAdmin {
+		httpError(w, http.StatusForbidden, "only group admins can "+action)
+		return 0, 0, false
+	}
+	return userID, convID, true
+}
+
+// respondConversation answers with the current state of a conversation plus extra fields.
+func respondConversation(w http.ResponseWriter, convID int64, extra map[string]any) {
+	conv, err := loadConversation(convID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	resp := map[string]any{"conversation": conv}
+	for k, v := range extra {
+		resp[k] = v
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// loadConversation reads a conversation with its participants.
+func loadConversation(convID int64) (conversationResponse, error) {
+	var c conversationResponse
+	var name sql.NullString
+	err := db.QueryRow(`
+		SELECT id, name, is_group, is_public, announcement_only, COALESCE(message_ttl, 0), ttl_mode, COALESCE(topic, ''), COALESCE(description, ''), created_at
+		FROM conversations WHERE id = ?`, convID).
+		Scan(&c.ID, &name, &c.IsGroup, &c.IsPublic, &c.AnnouncementOnly, &c.MessageTTL, &c.TTLMode, &c.Topic, &c.Description, &c.CreatedAt)
+	if err != nil {
+		return c, err
+	}
+	c.Name = name.String
+	c.ParticipantIDs, err = conversationParticipantIDs(convID)
+	if c.ParticipantIDs == nil {
+		c.ParticipantIDs = []int64{}
+	}
+	return c, err
+}
+
+// announceChange records a change with a system message and pushes the new
+// state of the conversation to its members and to alsoNotify (members who
+// just left or were removed).
+func announceChange(convID int64, ev systemEvent, alsoNotify ...int64) {
+	postSystemMessage(convID, ev)
+
+	conv, err := loadConversation(convID)
+	if err != nil {
+		log.Printf("Failed to load conversation %d for conversation_updated: %v", convID, err)
+		return
+	}
+	hub.Events <- Event{
+		RecipientIDs: uniqueIDs(append(append([]int64{}, conv.ParticipantIDs...), alsoNotify...)),
+		Payload: ConversationUpdatedEvent{
+			Type:         "conversation_updated",
+			Change:       ev.Event,
+			ActorID:      ev.ActorID,
+			UserIDs:      ev.UserIDs,
+			Conversation: conv,
+		},
+	}
+}
+
+// inviteParticipants adds users to a group on behalf of actorID and announces
+// the ones who were not members yet, which it returns.
+func inviteParticipants(convID, actorID int64, userIDs []int64) ([]int64, error) {
+	added := []int64{}
+	for _, uid := range userIDs {
+		ok, err := addParticipant(convID, uid)
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			added = append(added, uid)
+		}
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+
+	announceChange(convID, systemEvent{Event: systemMembersAdded, ActorID: actorID, UserIDs: added})
+	return added, nil
+}
+
+// dropParticipant removes userID from a group, as their own choice when
+// actorID is the same user, and announces it.
+func dropParticipant(convID, actorID, userID int64) error {
+	newOwnerID, err := removeParticipant(convID, userID)
+	if err != nil {
+		return err
+	}
+	if actorID == userID {
+		announceChange(convID, systemEvent{Event: systemMemberLeft, ActorID: userID}, userID)
+	} else {
+		announceChange(convID, systemEvent{Event: systemMemberRemoved, ActorID: actorID, UserIDs: []int64{userID}}, userID)
+	}
+	if newOwnerID > 0 {
+		announceChange(convID, systemEvent{Event: systemOwnerChanged, ActorID: userID, UserIDs: []int64{newOwnerID}})
+	}
+	return nil
+}
+
+// addParticipant adds a member to a conversation with nothing unread, and
+// reports false if they already were one.
+func addParticipant(convID, userID int64) (bool, error) {
+	res, err := db.Exec(`
+		INSERT INTO conversation_participants (conversation_id, user_id, role, last_read_seq, last_read_message_id)
+		SELECT c.id, ?, ?, c.last_seq, (SELECT id FROM messages WHERE conversation_id = c.id AND seq = c.last_seq)
+		FROM conversations c
+		WHERE c.id = ? AND NOT EXISTS (
+			SELECT 1 FROM conversation_participants WHERE conversation_id = c.id AND user_id = ?)`,
+		userID, roleMember, convID, userID)
+	if isDuplicateEntry(err) {
+		return false, nil // added by a concurrent request
+	}
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// removeParticipant takes a member out of a conversation. When the owner
+// goes, the longest-standing admin (or else member) takes over; their ID is
+// returned.
+func removeParticipant(convID, userID int64) (newOwnerID int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var role string
+	err = tx.QueryRow("SELECT role FROM conversation_participants WHERE conversation_id = ? AND user_id = ? FOR UPDATE", convID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return 0, errNotParticipant
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM conversation_participants WHERE conversation_id = ? AND user_id = ?", convID, userID); err != nil {
+		return 0, err
+	}
+	if role == roleOwner {
+		err := tx.QueryRow(`
+			SELECT user_id FROM conversation_participants
+			WHERE conversation_id = ?
+			ORDER BY role = ? DESC, joined_at, id
+			LIMIT 1 FOR UPDATE`, convID, roleAdmin).Scan(&newOwnerID)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		if newOwnerID > 0 {
+			if _, err := tx.Exec("UPDATE conversation_participants SET role = ? WHERE conversation_id = ? AND user_id = ?", roleOwner, convID, newOwnerID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	typing.Stop(convID, userID)
+	return newOwnerID, nil
+}
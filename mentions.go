@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ==== @mentions ====
+//
+// When a message is saved its text (see markdown.go) is scanned for
+// @username, @here (online members) and @all (every member). Only
+// conversation members can be mentioned. The entities are stored on the message (messages.mentions, JSON)
+// for rendering, and one row per mentioned user goes into message_mentions
+// for the mentions feed and the unread mention counter. Mentioned users also
+// get a "mention" WebSocket event on top of the normal message frame, unless
+// they muted the conversation.
+
+const (
+	mentionUser = "user"
+	mentionHere = "here"
+	mentionAll  = "all"
+)
+
+// mentionEntity is one @... occurrence. Offset and Length index the message's
+// text, the plain-text projection without Markdown markers (see markdown.go),
+// not its content. They are in UTF-16 code units so JavaScript clients can
+// slice the string directly.
+type mentionEntity struct {
+	Kind    string  `json:"kind"` // user, here, all
+	UserIDs []int64 `json:"user_ids"`
+	Offset  int     `json:"offset"`
+	Length  int     `json:"length"`
+}
+
+// mentionedUser is a user to notify, with the most specific way they were mentioned.
+type mentionedUser struct {
+	UserID int64
+	Kind   string
+}
+
+// MentionEvent is pushed to each mentioned user who is online.
+type MentionEvent struct {
+	Type           string `json:"type"` // "mention"
+	Kind           string `json:"kind"`
+	ConversationID int64  `json:"conversation_id"`
+	MessageID      int64  `json:"message_id"`
+	SenderID       int64  `json:"sender_id"`
+	Content        string `json:"content"`
+}
+
+type mentionMember struct {
+	ID       int64
+	Username string
+	Online   bool
+}
+
+// saveMentions parses the content of a stored message, records the mentions
+// and returns the entities plus the users to notify (never the sender).
+func saveMentions(msgID, convID, senderID int64, content string) ([]mentionEntity, []mentionedUser, error) {
+	if !strings.Contains(content, "@") {
+		return nil, nil, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.username, u.status
+		FROM conversation_participants cp
+		JOIN users u ON u.id = cp.user_id
+		WHERE cp.conversation_id = ?`, convID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var members []mentionMember
+	for rows.Next() {
+		var m mentionMember
+		var status string
+		if err := rows.Scan(&m.ID, &m.Username, &status); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		m.Online = status == "online"
+		members = append(members, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	entities := parseMentions(content, members)
+	if len(entities) == 0 {
+		return nil, nil, nil
+	}
+
+	// A direct @username beats @here/@all for the same user
+	kinds := map[int64]string{}
+	var order []int64
+	for _, e := range entities {
+		for _, uid := range e.UserIDs {
+			if uid == senderID {
+				continue
+			}
+			prev, seen := kinds[uid]
+			if !seen {
+				order = append(order, uid)
+			}
+			if !seen || (e.Kind == mentionUser && prev != mentionUser) {
+				kinds[uid] = e.Kind
+			}
+		}
+	}
+
+	// One statement for all of them: this runs on the Hub goroutine, and
+	// @all in a big group mentions everyone
+	var mentioned []mentionedUser
+	if len(order) > 0 {
+		args := make([]any, 0, 4*len(order))
+		for _, uid := range order {
+			args = append(args, msgID, convID, uid, kinds[uid])
+			mentioned = append(mentioned, mentionedUser{UserID: uid, Kind: kinds[uid]})
+		}
+		_, err := db.Exec("INSERT INTO message_mentions (message_id, conversation_id, user_id, kind) VALUES (?, ?, ?, ?)"+
+			strings.Repeat(", (?, ?, ?, ?)", len(order)-1), args...)
+		if err != nil {
+			return entities, nil, err
+		}
+	}
+
+	raw, _ := json.Marshal(entities)
+	if _, err := db.Exec("UPDATE messages SET mentions = ? WHERE id = ?", string(raw), msgID); err != nil {
+		return entities, mentioned, err
+	}
+	return entities, mentioned, nil
+}
+
+// parseMentions finds @here, @all and @<member username>. Usernames may
+// contain spaces ("Moses Gitau"), so the longest matching member name wins.
+// An @ preceded by a letter or digit (an e-mail address) is ignored.
+func parseMentions(content string, members []mentionMember) []mentionEntity {
+	var entities []mentionEntity
+	for i := 0; i < len(content); i++ {
+		if content[i] != '@' {
+			continue
+		}
+		if i > 0 {
+			prev, _ := utf8.DecodeLastRuneInString(content[:i])
+			if isMentionRune(prev) {
+				continue
+			}
+		}
+
+		rest := content[i+1:]
+		var e mentionEntity
+		n := 0
+		switch {
+		case hasMentionPrefix(rest, mentionHere):
+			e.Kind, n = mentionHere, len(mentionHere)
+			for _, m := range members {
+				if m.Online {
+					e.UserIDs = append(e.UserIDs, m.ID)
+				}
+			}
+		case hasMentionPrefix(rest, mentionAll):
+			e.Kind, n = mentionAll, len(mentionAll)
+			for _, m := range members {
+				e.UserIDs = append(e.UserIDs, m.ID)
+			}
+		default:
+			var best *mentionMember
+			for k := range members {
+				m := &members[k]
+				if len(m.Username) > n && hasMentionPrefix(rest, m.Username) {
+					best, n = m, len(m.Username)
+				}
+			}
+			if best == nil {
+				continue
+			}
+			e.Kind = mentionUser
+			e.UserIDs = []int64{best.ID}
+		}
+
+		e.Offset = utf16Len(content[:i])
+		e.Length = utf16Len(content[i : i+1+n])
+		entities = append(entities, e)
+		i += n
+	}
+	return entities
+}
+
+// hasMentionPrefix reports whether s starts with name (case-insensitive) and
+// the name is not immediately followed by another name character.
+func hasMentionPrefix(s, name string) bool {
+	if len(s) < len(name) || !strings.EqualFold(s[:len(name)], name) {
+		return false
+	}
+	next, _ := utf8.DecodeRuneInString(s[len(name):])
+	return next == utf8.RuneError || !isMentionRune(next)
+}
+
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func mentionEvents(msgID, convID, senderID int64, content string, mentioned []mentionedUser) []Event {
+	if len(mentioned) == 0 {
+		return nil
+	}
+	silenced, err := silencedUserIDs(convID)
+	if err != nil {
+		log.Printf("Failed to load muted members of conversation %d: %v", convID, err)
+	}
+	events := make([]Event, 0, len(mentioned))
+	for _, m := range mentioned {
+		if silenced[m.UserID] {
+			continue
+		}
+		events = append(events, Event{
+			RecipientIDs: []int64{m.UserID},
+			Payload: MentionEvent{
+				Type:           "mention",
+				Kind:           m.Kind,
+				ConversationID: convID,
+				MessageID:      msgID,
+				SenderID:       senderID,
+				Content:        content,
+			},
+		})
+	}
+	return events
+}
+
+// silencedUserIDs returns the members who currently have a conversation
+// muted or have declined it as a message request.
+func silencedUserIDs(convID int64) (map[int64]bool, error) {
+	rows, err := db.Query("SELECT user_id FROM conversation_participants WHERE conversation_id = ? AND (muted_until > NOW() OR message_request = 'declined')", convID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	silenced := map[int64]bool{}
+	for rows.Next() {
+		var uid int64
+		if err := rows.Scan(&uid); err != nil {
+			return silenced, err
+		}
+		silenced[uid] = true
+	}
+	return silenced, rows.Err()
+}
+
+// GET /api/users/me/mentions?limit=&before=&unread=true
+//
+// The caller's mentions across every conversation they still belong to,
+// newest first. next_cursor is a message ID to pass back as before=.
+func listMentionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultMessagePageSize
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxMessagePageSize {
+			limit = maxMessagePageSize
+		}
+	}
+
+	query := `
+		SELECT m.id, m.conversation_id, m.seq, m.sender_id, m.content, COALESCE(m.plain_text, m.content), m.entities, m.message_type, m.payload, m.created_at,
+		       mm.kind, c.name, c.is_group, m.seq <= cp.last_read_seq
+		FROM message_mentions mm
+		JOIN messages m ON m.id = mm.message_id
+		JOIN conversations c ON c.id = mm.conversation_id
+		JOIN conversation_participants cp ON cp.conversation_id = mm.conversation_id AND cp.user_id = mm.user_id
+		WHERE mm.user_id = ? AND ` + notExpired
+	args := []any{userID}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid before cursor")
+			return
+		}
+		query += " AND mm.message_id < ?"
+		args = append(args, before)
+	}
+	if q.Get("unread") == "true" {
+		query += " AND m.seq > cp.last_read_seq"
+	}
+	query += " ORDER BY mm.message_id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	type mentionItem struct {
+		Message      messageResponse      `json:"message"`
+		Conversation conversationResponse `json:"conversation"`
+		Kind         string               `json:"kind"`
+		Read         bool                 `json:"read"`
+	}
+	items := []mentionItem{}
+	for rows.Next() {
+		var it mentionItem
+		var name, payload, entities sql.NullString
+		m := &it.Message
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Seq, &m.SenderID, &m.Content, &m.Text, &entities, &m.MessageType, &payload, &m.CreatedAt,
+			&it.Kind, &name, &it.Conversation.IsGroup, &it.Read); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		m.richPayload = decodeRichPayload(m.ID, m.MessageType, payload)
+		m.Entities = decodeEntities(entities)
+		it.Conversation.ID = m.ConversationID
+		it.Conversation.Name = name.String
+		items = append(items, it)
+	}
+
+	resp := map[string]any{"mentions": items, "has_more": false, "next_cursor": nil}
+	if len(items) > limit {
+		items = items[:limit]
+		resp["mentions"] = items
+		resp["has_more"] = true
+		resp["next_cursor"] = items[limit-1].Message.ID
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	members := []mentionMember{
+		{ID: 1, Username: "alice", Online: true},
+		{ID: 2, Username: "Moses", Online: false},
+		{ID: 3, Username: "Moses Gitau", Online: true},
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    []mentionEntity
+	}{
+		{"none", "hello", nil},
+		{"user", "hi @alice!", []mentionEntity{
+			{Kind: mentionUser, UserIDs: []int64{1}, Offset: 3, Length: 6},
+		}},
+		{"case-insensitive", "@ALICE", []mentionEntity{
+			{Kind: mentionUser, UserIDs: []int64{1}, Offset: 0, Length: 6},
+		}},
+		{"longest name wins", "@Moses Gitau hi", []mentionEntity{
+			{Kind: mentionUser, UserIDs: []int64{3}, Offset: 0, Length: 12},
+		}},
+		{"shorter name", "@Moses hi", []mentionEntity{
+			{Kind: mentionUser, UserIDs: []int64{2}, Offset: 0, Length: 6},
+		}},
+		{"here is online members", "@here", []mentionEntity{
+			{Kind: mentionHere, UserIDs: []int64{1, 3}, Offset: 0, Length: 5},
+		}},
+		{"all", "@all go", []mentionEntity{
+			{Kind: mentionAll, UserIDs: []int64{1, 2, 3}, Offset: 0, Length: 4},
+		}},
+		{"e-mail address", "mail bob@alice.com", nil},
+		{"name followed by letters", "@alicex", nil},
+		{"unknown user", "@nobody", nil},
+		{"utf-16 offset", "😀 @alice", []mentionEntity{
+			{Kind: mentionUser, UserIDs: []int64{1}, Offset: 3, Length: 6},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMentions(tt.content, members); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMentions(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
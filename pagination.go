@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+)
+
+// ==== Message history pagination ====
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+// messagePage is the response body of GET /api/messages. Cursors are seq
+// values (see seq.go); only around_id takes a message ID.
+type messagePage struct {
+	Messages   []messageResponse `json:"messages"`
+	HasMore    bool              `json:"has_more"`
+	NextCursor *int64            `json:"next_cursor"`
+
+	// Only set in around_id= mode, where the page can be extended both ways.
+	// There has_more/next_cursor describe the older side.
+	HasMoreAfter bool   `json:"has_more_after,omitempty"`
+	AfterCursor  *int64 `json:"after_cursor,omitempty"`
+}
+
+const messageColumns = "id, conversation_id, seq, sender_id, content, COALESCE(plain_text, content), entities, message_type, payload, mentions, forwarded_from_message_id, forwarded_from_user_id, expires_at, client_msg_id, created_at"
+
+// messagesBefore returns the newest `limit` messages with a seq below
+// `before` (or the newest messages overall when before is 0), oldest first.
+func messagesBefore(convID, viewerID, before int64, limit int) (messagePage, error) {
+	query := "SELECT " + messageColumns + " FROM messages m WHERE m.conversation_id = ? AND " + notExpired
+	args := []any{convID}
+	if before > 0 {
+		query += " AND m.seq < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY m.seq DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	msgs, err := queryMessages(viewerID, query, args...)
+	if err != nil {
+		return messagePage{}, err
+	}
+
+	page := messagePage{Messages: msgs}
+	if len(msgs) > limit {
+		page.Messages = msgs[:limit]
+		page.HasMore = true
+	}
+	reverseMessages(page.Messages)
+	if page.HasMore {
+		page.NextCursor = &page.Messages[0].Seq
+	}
+	return page, nil
+}
+
+// messagesAfter returns the oldest `limit` messages with a seq above `after`,
+// oldest first.
+func messagesAfter(convID, viewerID, after int64, limit int) (messagePage, error) {
+	msgs, err := queryMessages(viewerID,
+		"SELECT "+messageColumns+" FROM messages m WHERE m.conversation_id = ? AND m.seq > ? AND "+notExpired+" ORDER BY m.seq ASC LIMIT ?",
+		convID, after, limit+1)
+	if err != nil {
+		return messagePage{}, err
+	}
+
+	page := messagePage{Messages: msgs}
+	if len(msgs) > limit {
+		page.Messages = msgs[:limit]
+		page.HasMore = true
+		page.NextCursor = &page.Messages[limit-1].Seq
+	}
+	return page, nil
+}
+
+// messagesAround returns a page containing the target message with roughly
+// half of the limit on each side of it. It returns sql.ErrNoRows if the target
+// is not in the conversation.
+func messagesAround(convID, viewerID, target int64, limit int) (messagePage, error) {
+	if limit < 2 {
+		limit = 2 // one on each side at the very least
+	}
+
+	// target is a message ID (from search, mentions...), the page goes by seq
+	var seq int64
+	err := db.QueryRow("SELECT m.seq FROM messages m WHERE m.id = ? AND m.conversation_id = ? AND "+notExpired, target, convID).Scan(&seq)
+	if err != nil {
+		return messagePage{}, err
+	}
+
+	// The target itself counts towards the older half
+	older, err := messagesBefore(convID, viewerID, seq+1, limit-limit/2)
+	if err != nil {
+		return messagePage{}, err
+	}
+	newer, err := messagesAfter(convID, viewerID, seq, limit/2)
+	if err != nil {
+		return messagePage{}, err
+	}
+
+	page := messagePage{
+		Messages:     append(older.Messages, newer.Messages...),
+		HasMore:      older.HasMore,
+		NextCursor:   older.NextCursor,
+		HasMoreAfter: newer.HasMore,
+		AfterCursor:  newer.NextCursor,
+	}
+	return page, nil
+}
+
+// queryMessages runs a query selecting messageColumns. client_msg_id is only
+// filled in on viewerID's own messages.
+func queryMessages(viewerID int64, query string, args ...any) ([]messageResponse, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []messageResponse{}
+	for rows.Next() {
+		var m messageResponse
+		var mentions sql.NullString
+		var fwdMessageID, fwdSenderID sql.NullInt64
+		var clientMsgID, payload, entities sql.NullString
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Seq, &m.SenderID, &m.Content, &m.Text, &entities, &m.MessageType, &payload, &mentions,
+			&fwdMessageID, &fwdSenderID, &m.ExpiresAt, &clientMsgID, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		if mentions.Valid {
+			json.Unmarshal([]byte(mentions.String), &m.Mentions)
+		}
+		m.ForwardedFrom = newForwardRef(fwdMessageID, fwdSenderID)
+		if m.SenderID == viewerID {
+			m.ClientMsgID = clientMsgID.String
+		}
+		m.richPayload = decodeRichPayload(m.ID, m.MessageType, payload)
+		m.Entities = decodeEntities(entities)
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func reverseMessages(msgs []messageResponse) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// ==== Rich message types ====
+//
+// location, contact, voice and poll messages carry a structured payload next to
+// content. The payload is validated on the way in, stored as JSON in
+// messages.payload and returned in the field named after the type. content
+// holds a plain-text fallback ("📍 Nairobi", "Contact: alice", "Voice message
+// (0:12)", "📊 Lunch?") for search, notifications and clients that do not
+// know the type; the server fills it in when the client leaves it empty.
+// Polls are covered in polls.go.
+
+const (
+	maxLocationLabelLength = 200
+	maxVoiceDuration       = 15 * 60 * 1000 // ms
+	maxWaveformSamples     = 256
+)
+
+// clientMessageTypes are the types a client may send; system messages only
+// come from the server.
+var clientMessageTypes = map[string]bool{
+	"text": true, "image": true, "video": true, "file": true,
+	"location": true, "contact": true, "voice": true, "poll": true,
+}
+
+type locationPayload struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Label     string  `json:"label,omitempty"`
+}
+
+// contactPayload references a user; Username is filled in by the server.
+type contactPayload struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type voicePayload struct {
+	URL        string `json:"url"`
+	DurationMs int64  `json:"duration_ms"`
+	// Waveform is the amplitude envelope for the player, 0-255 per sample
+	Waveform []int `json:"waveform,omitempty"`
+}
+
+// richPayload is embedded in the request and message types; at most one field
+// is set, matching message_type.
+type richPayload struct {
+	Location *locationPayload `json:"location,omitempty"`
+	Contact  *contactPayload  `json:"contact,omitempty"`
+	Voice    *voicePayload    `json:"voice,omitempty"`
+	Poll     *pollPayload     `json:"poll,omitempty"`
+	System   *systemEvent     `json:"system,omitempty"` // server-written, see system.go
+}
+
+// validateMessageBody checks message_type (defaulting it to text) and the
+// payload that goes with it, resolves contact cards and fills in the
+// fallback content.
+func validateMessageBody(convID int64, messageType *string, content *string, p *richPayload) error {
+	if *messageType == "" {
+		*messageType = "text"
+	}
+	if !clientMessageTypes[*messageType] {
+		return fmt.Errorf("unknown message_type %q", *messageType)
+	}
+
+	set := map[string]bool{"location": p.Location != nil, "contact": p.Contact != nil, "voice": p.Voice != nil, "poll": p.Poll != nil, "system": p.System != nil}
+	for kind, present := range set {
+		if present && kind != *messageType {
+			return fmt.Errorf("%s is only allowed on %s messages", kind, kind)
+		}
+	}
+	if _, rich := set[*messageType]; rich && !set[*messageType] {
+		return fmt.Errorf("%s messages need a %s object", *messageType, *messageType)
+	}
+
+	var fallback string
+	switch *messageType {
+	case "location":
+		l := p.Location
+		if math.IsNaN(l.Latitude) || l.Latitude < -90 || l.Latitude > 90 {
+			return errors.New("location.latitude must be between -90 and 90")
+		}
+		if math.IsNaN(l.Longitude) || l.Longitude < -180 || l.Longitude > 180 {
+			return errors.New("location.longitude must be between -180 and 180")
+		}
+		l.Label = strings.TrimSpace(l.Label)
+		if utf8.RuneCountInString(l.Label) > maxLocationLabelLength {
+			return fmt.Errorf("location.label must be at most %d characters", maxLocationLabelLength)
+		}
+		fallback = "📍 " + l.Label
+		if l.Label == "" {
+			fallback = fmt.Sprintf("📍 %.5f, %.5f", l.Latitude, l.Longitude)
+		}
+
+	case "contact":
+		c := p.Contact
+		err := db.QueryRow("SELECT username FROM users WHERE id = ?", c.UserID).Scan(&c.Username)
+		if err == sql.ErrNoRows {
+			return errors.New("contact.user_id does not exist")
+		}
+		if err != nil {
+			return err
+		}
+		fallback = "Contact: " + c.Username
+
+	case "voice":
+		v := p.Voice
+		if v.URL == "" || !(strings.HasPrefix(v.URL, "https://") || strings.HasPrefix(v.URL, "http://") || strings.HasPrefix(v.URL, "/")) {
+			return errors.New("voice.url must be an http(s) URL or an absolute path")
+		}
+		if v.DurationMs <= 0 || v.DurationMs > maxVoiceDuration {
+			return fmt.Errorf("voice.duration_ms must be between 1 and %d", maxVoiceDuration)
+		}
+		if len(v.Waveform) > maxWaveformSamples {
+			return fmt.Errorf("voice.waveform must have at most %d samples", maxWaveformSamples)
+		}
+		for _, s := range v.Waveform {
+			if s < 0 || s > 255 {
+				return errors.New("voice.waveform samples must be between 0 and 255")
+			}
+		}
+		secs := (v.DurationMs + 999) / 1000
+		fallback = fmt.Sprintf("Voice message (%d:%02d)", secs/60, secs%60)
+
+	case "poll":
+		if err := validatePoll(convID, p.Poll); err != nil {
+			return err
+		}
+		fallback = "📊 " + p.Poll.Question
+	}
+
+	if strings.TrimSpace(*content) == "" {
+		*content = fallback
+	}
+	return nil
+}
+
+// encode returns the JSON for messages.payload, NULL for plain messages.
+func (p richPayload) encode() sql.NullString {
+	var v any
+	switch {
+	case p.Location != nil:
+		v = p.Location
+	case p.Contact != nil:
+		v = p.Contact
+	case p.Voice != nil:
+		v = p.Voice
+	case p.Poll != nil:
+		v = p.Poll
+	case p.System != nil:
+		v = p.System
+	default:
+		return sql.NullString{}
+	}
+	raw, _ := json.Marshal(v)
+	return sql.NullString{String: string(raw), Valid: true}
+}
+
+// decodeRichPayload is the inverse of encode for a stored message. Polls come
+// back with their current results.
+func decodeRichPayload(msgID int64, messageType string, raw sql.NullString) richPayload {
+	var p richPayload
+	if !raw.Valid {
+		return p
+	}
+	switch messageType {
+	case "location":
+		p.Location = &locationPayload{}
+		json.Unmarshal([]byte(raw.String), p.Location)
+	case "contact":
+		p.Contact = &contactPayload{}
+		json.Unmarshal([]byte(raw.String), p.Contact)
+	case "voice":
+		p.Voice = &voicePayload{}
+		json.Unmarshal([]byte(raw.String), p.Voice)
+	case "poll":
+		p.Poll = &pollPayload{}
+		json.Unmarshal([]byte(raw.String), p.Poll)
+		if err := loadPollResults(msgID, p.Poll); err != nil {
+			log.Printf("Failed to load results of poll %d: %v", msgID, err)
+		}
+	case "system":
+		p.System = &systemEvent{}
+		json.Unmarshal([]byte(raw.String), p.System)
+	}
+	return p
+}
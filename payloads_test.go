@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// These cases never reach the database: contact cards and polls, which look
+// things up, are left to an integration setup.
+func TestValidateMessageBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     string
+		content string
+		payload richPayload
+		wantErr string // substring; empty for success
+		wantTyp string
+		wantCon string
+	}{
+		{name: "defaults to text", typ: "", content: "hi", wantTyp: "text", wantCon: "hi"},
+		{name: "unknown type", typ: "sticker", content: "x", wantErr: "unknown message_type"},
+		{name: "system is server-only", typ: "system", content: "x", wantErr: "unknown message_type"},
+		{name: "payload on the wrong type", typ: "text", content: "x",
+			payload: richPayload{Location: &locationPayload{}}, wantErr: "location is only allowed on location messages"},
+		{name: "missing payload", typ: "voice", wantErr: "voice messages need a voice object"},
+		{name: "location fallback", typ: "location",
+			payload: richPayload{Location: &locationPayload{Latitude: -1.28333, Longitude: 36.81667, Label: "  Nairobi "}},
+			wantTyp: "location", wantCon: "📍 Nairobi"},
+		{name: "location without label", typ: "location",
+			payload: richPayload{Location: &locationPayload{Latitude: 1.5, Longitude: 2.25}},
+			wantTyp: "location", wantCon: "📍 1.50000, 2.25000"},
+		{name: "content is kept", typ: "location", content: "meet here",
+			payload: richPayload{Location: &locationPayload{Latitude: 1, Longitude: 2}},
+			wantTyp: "location", wantCon: "meet here"},
+		{name: "latitude out of range", typ: "location",
+			payload: richPayload{Location: &locationPayload{Latitude: 91}}, wantErr: "latitude"},
+		{name: "latitude NaN", typ: "location",
+			payload: richPayload{Location: &locationPayload{Latitude: math.NaN()}}, wantErr: "latitude"},
+		{name: "longitude out of range", typ: "location",
+			payload: richPayload{Location: &locationPayload{Longitude: -181}}, wantErr: "longitude"},
+		{name: "label too long", typ: "location",
+			payload: richPayload{Location: &locationPayload{Label: strings.Repeat("x", maxLocationLabelLength+1)}}, wantErr: "label"},
+		{name: "voice fallback", typ: "voice",
+			payload: richPayload{Voice: &voicePayload{URL: "https://cdn.example.com/v.ogg", DurationMs: 12001, Waveform: []int{0, 128, 255}}},
+			wantTyp: "voice", wantCon: "Voice message (0:13)"},
+		{name: "voice bad url", typ: "voice",
+			payload: richPayload{Voice: &voicePayload{URL: "javascript:x", DurationMs: 1000}}, wantErr: "voice.url"},
+		{name: "voice too long", typ: "voice",
+			payload: richPayload{Voice: &voicePayload{URL: "/v.ogg", DurationMs: maxVoiceDuration + 1}}, wantErr: "duration_ms"},
+		{name: "voice waveform sample", typ: "voice",
+			payload: richPayload{Voice: &voicePayload{URL: "/v.ogg", DurationMs: 1000, Waveform: []int{256}}}, wantErr: "waveform"},
+		{name: "voice waveform length", typ: "voice",
+			payload: richPayload{Voice: &voicePayload{URL: "/v.ogg", DurationMs: 1000, Waveform: make([]int, maxWaveformSamples+1)}}, wantErr: "waveform"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, content, payload := tt.typ, tt.content, tt.payload
+			err := validateMessageBody(1, &typ, &content, &payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if typ != tt.wantTyp || content != tt.wantCon {
+				t.Errorf("got type %q content %q, want %q %q", typ, content, tt.wantTyp, tt.wantCon)
+			}
+		})
+	}
+}
+
+func TestRichPayloadEncodeDecode(t *testing.T) {
+	if got := (richPayload{}).encode(); got.Valid {
+		t.Errorf("empty payload encodes to %q, want NULL", got.String)
+	}
+	in := richPayload{Voice: &voicePayload{URL: "/v.ogg", DurationMs: 1500, Waveform: []int{1, 2}}}
+	out := decodeRichPayload(0, "voice", in.encode())
+	if out.Voice == nil || out.Voice.URL != "/v.ogg" || out.Voice.DurationMs != 1500 || len(out.Voice.Waveform) != 2 {
+		t.Errorf("round trip = %+v", out.Voice)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+)
+
+// ==== Pinned messages ====
+//
+// In a group only owners and admins can pin; in a 1-on-1 either side can.
+// Every participant can list the pins. Pin/unpin is pushed to the
+// conversation as a message_pinned/message_unpinned event and recorded in the
+// timeline with a system message.
+
+const maxPinsPerConversation = 5
+
+type pinResponse struct {
+	Message  messageResponse `json:"message"`
+	PinnedBy int64           `json:"pinned_by"`
+	PinnedAt time.Time       `json:"pinned_at"`
+}
+
+// PinEvent is pushed to every participant when a pin changes.
+type PinEvent struct {
+	Type           string `json:"type"` // "message_pinned" or "message_unpinned"
+	ConversationID int64  `json:"conversation_id"`
+	MessageID      int64  `json:"message_id"`
+	UserID         int64  `json:"user_id"` // who pinned or unpinned
+}
+
+// GET /api/conversations/{id}/pins
+func listPinsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	convID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	if _, _, err := participantRole(convID, userID); err != nil {
+		participantError(w, err)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT m.id, m.conversation_id, m.seq, m.sender_id, m.content, COALESCE(m.plain_text, m.content), m.entities, m.message_type, m.payload, m.mentions, m.created_at,
+		       p.pinned_by, p.pinned_at
+		FROM pinned_messages p
+		JOIN messages m ON m.id = p.message_id
+		WHERE p.conversation_id = ? AND `+notExpired+`
+		ORDER BY p.pinned_at DESC, p.id DESC`, convID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	pins := []pinResponse{}
+	for rows.Next() {
+		var p pinResponse
+		var mentions, payload, entities sql.NullString
+		m := &p.Message
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Seq, &m.SenderID, &m.Content, &m.Text, &entities, &m.MessageType, &payload, &mentions, &m.CreatedAt,
+			&p.PinnedBy, &p.PinnedAt); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		m.richPayload = decodeRichPayload(m.ID, m.MessageType, payload)
+		m.Entities = decodeEntities(entities)
+		if mentions.Valid {
+			json.Unmarshal([]byte(mentions.String), &m.Mentions)
+		}
+		pins = append(pins, p)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{"pins": pins, "max_pins": maxPinsPerConversation})
+}
+
+// POST /api/conversations/{id}/pins {"message_id": N}
+func pinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	convID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	var req struct {
+		MessageID int64 `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID <= 0 {
+		httpError(w, http.StatusBadRequest, "message_id required")
+		return
+	}
+	if !canManagePins(w, convID, userID) {
+		return
+	}
+
+	var content string
+	err = db.QueryRow("SELECT COALESCE(m.plain_text, m.content) FROM messages m WHERE m.id = ? AND m.conversation_id = ? AND "+notExpired, req.MessageID, convID).Scan(&content)
+	if err == sql.ErrNoRows {
+		httpError(w, http.StatusNotFound, "message not found in this conversation")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the conversation row serializes concurrent pins, so the count
+	// cannot go stale before the insert.
+	if _, err := tx.Exec("SELECT id FROM conversations WHERE id = ? FOR UPDATE", convID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pinned_messages WHERE conversation_id = ?", convID).Scan(&count); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if count >= maxPinsPerConversation {
+		httpError(w, http.StatusConflict, fmt.Sprintf("a conversation can have at most %d pinned messages", maxPinsPerConversation))
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO pinned_messages (conversation_id, message_id, pinned_by) VALUES (?, ?, ?)", convID, req.MessageID, userID)
+	if err != nil {
+		if me, ok := err.(*mysqlDriver.MySQLError); ok && me.Number == 1062 {
+			httpError(w, http.StatusConflict, "message already pinned")
+			return
+		}
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	broadcastPinEvent("message_pinned", convID, req.MessageID, userID)
+	postSystemMessage(convID, systemEvent{Event: systemMessagePinned, ActorID: userID, MessageID: req.MessageID, Preview: truncateRunes(content, 50)})
+
+	respondJSON(w, http.StatusCreated, map[string]any{"conversation_id": convID, "message_id": req.MessageID, "pinned_by": userID})
+}
+
+// DELETE /api/conversations/{id}/pins/{message_id}
+func unpinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	vars := mux.Vars(r)
+	convID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	msgID, err := strconv.ParseInt(vars["message_id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	if !canManagePins(w, convID, userID) {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM pinned_messages WHERE conversation_id = ? AND message_id = ?", convID, msgID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "message is not pinned")
+		return
+	}
+
+	broadcastPinEvent("message_unpinned", convID, msgID, userID)
+	postSystemMessage(convID, systemEvent{Event: systemMessageUnpinned, ActorID: userID, MessageID: msgID})
+
+	respondJSON(w, http.StatusOK, map[string]any{"conversation_id": convID, "message_id": msgID})
+}
+
+// canManagePins writes the error response and returns false if the user may
+// not pin in this conversation.
+func canManagePins(w http.ResponseWriter, convID, userID int64) bool {
+	role, isGroup, err := participantRole(convID, userID)
+	if err != nil {
+		participantError(w, err)
+		return false
+	}
+	if isGroup && role != roleOwner && role != roleAdmin {
+		httpError(w, http.StatusForbidden, "only group admins can pin messages")
+		return false
+	}
+	return true
+}
+
+func broadcastPinEvent(eventType string, convID, msgID, userID int64) {
+	participantIDs, err := conversationParticipantIDs(convID)
+	if err != nil {
+		return
+	}
+	hub.Events <- Event{
+		RecipientIDs: participantIDs,
+		Payload: PinEvent{
+			Type:           eventType,
+			ConversationID: convID,
+			MessageID:      msgID,
+			UserID:         userID,
+		},
+	}
+}
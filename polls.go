@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Polls ====
+//
+// A poll is a group message with message_type "poll" and a poll object:
+//
+//	{"question": "Lunch?", "options": [{"text": "Pizza"}, {"text": "Sushi"}],
+//	 "multiple_choice": false, "anonymous": false, "closes_at": "..."}
+//
+// Options are numbered 0..n-1 in the order given. The definition is stored in
+// messages.payload like the other rich types; the state lives in polls (one
+// row per poll, closed_at) and poll_votes. Every vote or retraction pushes
+// poll_updated with the new tally to the conversation, and runPollCloser
+// closes polls whose closes_at has passed with a final poll_closed. Anonymous
+// polls only ever report counts.
+
+const (
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+	minPollOptions        = 2
+	maxPollOptions        = 10
+	maxPollDuration       = 30 * 24 * time.Hour
+	pollCloserInterval    = 5 * time.Second
+)
+
+type pollOption struct {
+	ID       int     `json:"id"`
+	Text     string  `json:"text"`
+	Votes    int     `json:"votes"`
+	VoterIDs []int64 `json:"voter_ids,omitempty"` // left out of anonymous polls
+}
+
+type pollPayload struct {
+	Question       string       `json:"question"`
+	Options        []pollOption `json:"options"`
+	MultipleChoice bool         `json:"multiple_choice"`
+	Anonymous      bool         `json:"anonymous"`
+	ClosesAt       *time.Time   `json:"closes_at,omitempty"`
+
+	// Live state, filled in from polls/poll_votes when the message is read
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+	TotalVoters int        `json:"total_voters"`
+}
+
+// PollEvent carries the current tally of a poll.
+type PollEvent struct {
+	Type           string      `json:"type"` // "poll_updated" or "poll_closed"
+	ConversationID int64       `json:"conversation_id"`
+	MessageID      int64       `json:"message_id"`
+	Poll           pollPayload `json:"poll"`
+}
+
+// validatePoll checks a new poll and numbers its options.
+func validatePoll(convID int64, p *pollPayload) error {
+	var isGroup bool
+	err := db.QueryRow("SELECT is_group FROM conversations WHERE id = ?", convID).Scan(&isGroup)
+	if err == sql.ErrNoRows {
+		return errors.New("conversation not found")
+	}
+	if err != nil {
+		return err
+	}
+	if !isGroup {
+		return errors.New("polls can only be posted in group conversations")
+	}
+
+	p.Question = strings.TrimSpace(p.Question)
+	if p.Question == "" || utf8.RuneCountInString(p.Question) > maxPollQuestionLength {
+		return fmt.Errorf("poll.question must be 1 to %d characters", maxPollQuestionLength)
+	}
+	if len(p.Options) < minPollOptions || len(p.Options) > maxPollOptions {
+		return fmt.Errorf("a poll needs between %d and %d options", minPollOptions, maxPollOptions)
+	}
+	seen := map[string]bool{}
+	for i := range p.Options {
+		o := &p.Options[i]
+		o.Text = strings.TrimSpace(o.Text)
+		if o.Text == "" || utf8.RuneCountInString(o.Text) > maxPollOptionLength {
+			return fmt.Errorf("poll options must be 1 to %d characters", maxPollOptionLength)
+		}
+		if seen[strings.ToLower(o.Text)] {
+			return fmt.Errorf("duplicate poll option %q", o.Text)
+		}
+		seen[strings.ToLower(o.Text)] = true
+		o.ID, o.Votes, o.VoterIDs = i, 0, nil
+	}
+	if p.ClosesAt != nil {
+		if !p.ClosesAt.After(time.Now()) || p.ClosesAt.After(time.Now().Add(maxPollDuration)) {
+			return errors.New("poll.closes_at must be in the future and at most 30 days away")
+		}
+		utc := p.ClosesAt.UTC()
+		p.ClosesAt = &utc
+	}
+	p.ClosedAt, p.TotalVoters = nil, 0
+	return nil
+}
+
+// insertPoll creates the state row of a poll message inside its insert transaction.
+func insertPoll(tx *sql.Tx, msgID, convID int64, p *pollPayload) error {
+	_, err := tx.Exec("INSERT INTO polls (message_id, conversation_id, multiple_choice, anonymous, closes_at) VALUES (?, ?, ?, ?, ?)",
+		msgID, convID, p.MultipleChoice, p.Anonymous, p.ClosesAt)
+	return err
+}
+
+// loadPollResults fills in the tally and closed state of a poll.
+func loadPollResults(msgID int64, p *pollPayload) error {
+	var closedAt *time.Time
+	if err := db.QueryRow("SELECT closed_at FROM polls WHERE message_id = ?", msgID).Scan(&closedAt); err != nil {
+		return err
+	}
+	p.ClosedAt = closedAt
+
+	rows, err := db.Query("SELECT option_id, user_id FROM poll_votes WHERE message_id = ? ORDER BY id", msgID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for i := range p.Options {
+		p.Options[i].Votes, p.Options[i].VoterIDs = 0, nil
+	}
+	voters := map[int64]bool{}
+	for rows.Next() {
+		var optionID int
+		var userID int64
+		if err := rows.Scan(&optionID, &userID); err != nil {
+			return err
+		}
+		if optionID < 0 || optionID >= len(p.Options) {
+			continue
+		}
+		o := &p.Options[optionID]
+		o.Votes++
+		if !p.Anonymous {
+			o.VoterIDs = append(o.VoterIDs, userID)
+		}
+		voters[userID] = true
+	}
+	p.TotalVoters = len(voters)
+	return rows.Err()
+}
+
+// loadPoll reads a poll message with its current results.
+func loadPoll(msgID int64) (convID int64, p pollPayload, err error) {
+	var messageType string
+	var raw sql.NullString
+	err = db.QueryRow("SELECT m.conversation_id, m.message_type, m.payload FROM messages m WHERE m.id = ? AND "+notExpired, msgID).
+		Scan(&convID, &messageType, &raw)
+	if err != nil {
+		return 0, p, err
+	}
+	if messageType != "poll" || !raw.Valid {
+		return 0, p, sql.ErrNoRows
+	}
+	if err := json.Unmarshal([]byte(raw.String), &p); err != nil {
+		return 0, p, err
+	}
+	return convID, p, loadPollResults(msgID, &p)
+}
+
+// POST /api/messages/{id}/votes {"option_ids": [0, 2]}
+// Replaces the caller's previous votes on the poll.
+func votePollHandler(w http.ResponseWriter, r *http.Request) {
+	userID, msgID, ok := pollRequest(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		OptionIDs []int `json:"option_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	convID, poll, ok := openPoll(w, msgID, userID)
+	if !ok {
+		return
+	}
+	if len(req.OptionIDs) == 0 {
+		httpError(w, http.StatusBadRequest, "option_ids required")
+		return
+	}
+	if !poll.MultipleChoice && len(req.OptionIDs) > 1 {
+		httpError(w, http.StatusBadRequest, "this poll allows a single choice")
+		return
+	}
+	chosen := map[int]bool{}
+	for _, id := range req.OptionIDs {
+		if id < 0 || id >= len(poll.Options) {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("option %d does not exist", id))
+			return
+		}
+		chosen[id] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+	if !lockOpenPoll(w, tx, msgID) {
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?", msgID, userID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	for id := range chosen {
+		if _, err := tx.Exec("INSERT INTO poll_votes (message_id, option_id, user_id) VALUES (?, ?, ?)", msgID, id, userID); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	respondPollChange(w, convID, msgID, poll)
+}
+
+// DELETE /api/messages/{id}/votes
+func retractVoteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, msgID, ok := pollRequest(w, r)
+	if !ok {
+		return
+	}
+	convID, poll, ok := openPoll(w, msgID, userID)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+	if !lockOpenPoll(w, tx, msgID) {
+		return
+	}
+	res, err := tx.Exec("DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?", msgID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "you have not voted on this poll")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	respondPollChange(w, convID, msgID, poll)
+}
+
+func pollRequest(w http.ResponseWriter, r *http.Request) (userID, msgID int64, ok bool) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return 0, 0, false
+	}
+	msgID, err = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid message id")
+		return 0, 0, false
+	}
+	return userID, msgID, true
+}
+
+// openPoll loads a poll the user may vote on, writing the error response and
+// returning false otherwise.
+func openPoll(w http.ResponseWriter, msgID, userID int64) (int64, pollPayload, bool) {
+	convID, poll, err := loadPoll(msgID)
+	if err == sql.ErrNoRows {
+		httpError(w, http.StatusNotFound, "poll not found")
+		return 0, poll, false
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return 0, poll, false
+	}
+	if _, _, err := participantRole(convID, userID); err != nil {
+		participantError(w, err)
+		return 0, poll, false
+	}
+	if poll.ClosedAt != nil || (poll.ClosesAt != nil && !poll.ClosesAt.After(time.Now())) {
+		httpError(w, http.StatusConflict, "this poll is closed")
+		return 0, poll, false
+	}
+	return convID, poll, true
+}
+
+// lockOpenPoll locks the poll row for the rest of tx, so a user's votes are
+// replaced one request at a time and none lands after runPollCloser closed
+// the poll. It writes the error response and returns false if the poll is
+// closed by now.
+func lockOpenPoll(w http.ResponseWriter, tx *sql.Tx, msgID int64) bool {
+	var closed bool
+	err := tx.QueryRow(`
+		SELECT closed_at IS NOT NULL OR (closes_at IS NOT NULL AND closes_at <= NOW())
+		FROM polls WHERE message_id = ? FOR UPDATE`, msgID).Scan(&closed)
+	if err == sql.ErrNoRows {
+		httpError(w, http.StatusNotFound, "poll not found")
+		return false
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return false
+	}
+	if closed {
+		httpError(w, http.StatusConflict, "this poll is closed")
+		return false
+	}
+	return true
+}
+
+// respondPollChange reloads the tally, pushes it to the conversation and
+// returns it to the caller.
+func respondPollChange(w http.ResponseWriter, convID, msgID int64, poll pollPayload) {
+	if err := loadPollResults(msgID, &poll); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	broadcastPollEvent("poll_updated", convID, msgID, poll)
+	respondJSON(w, http.StatusOK, map[string]any{"message_id": msgID, "poll": poll})
+}
+
+func broadcastPollEvent(eventType string, convID, msgID int64, poll pollPayload) {
+	participantIDs, err := conversationParticipantIDs(convID)
+	if err != nil {
+		return
+	}
+	hub.Events <- Event{
+		RecipientIDs: participantIDs,
+		Payload: PollEvent{
+			Type:           eventType,
+			ConversationID: convID,
+			MessageID:      msgID,
+			Poll:           poll,
+		},
+	}
+}
+
+// runPollCloser closes polls past their deadline until the process exits.
+func runPollCloser() {
+	ticker := time.NewTicker(pollCloserInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		closeDuePolls()
+	}
+}
+
+func closeDuePolls() {
+	rows, err := db.Query("SELECT message_id FROM polls WHERE closed_at IS NULL AND closes_at <= NOW()")
+	if err != nil {
+		log.Printf("Poll closer: query failed: %v", err)
+		return
+	}
+	var due []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Poll closer: scan failed: %v", err)
+			continue
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, msgID := range due {
+		res, err := db.Exec("UPDATE polls SET closed_at = NOW() WHERE message_id = ? AND closed_at IS NULL", msgID)
+		if err != nil {
+			log.Printf("Poll closer: failed to close poll %d: %v", msgID, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		convID, poll, err := loadPoll(msgID)
+		if err != nil {
+			log.Printf("Poll closer: failed to load poll %d: %v", msgID, err)
+			continue
+		}
+		broadcastPollEvent("poll_closed", convID, msgID, poll)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Scheduled messages ====
+//
+// POST /api/messages with a future send_at stores the message in
+// scheduled_messages instead of sending it, once its body passed the same
+// checks as an immediate send. Every message type can be scheduled. The owner
+// can list, edit and cancel it until it goes out:
+//
+//	GET    /api/scheduled-messages?status=pending&conversation_id=
+//	PATCH  /api/scheduled-messages/{id} {"content", "message_type", "location"..., "send_at"}
+//	DELETE /api/scheduled-messages/{id}
+//
+// A PATCH that sets message_type or a payload replaces the payload; without
+// content the fallback content is filled in again.
+//
+// runScheduler polls the table and hands due rows to Hub.Deliver, the same
+// save-and-broadcast path as live messages. Rows only leave 'pending' through
+// an atomic claim, so pending messages survive a restart and a row is never
+// picked up twice.
+
+const (
+	schedulerInterval   = 2 * time.Second
+	schedulerBatchSize  = 50
+	maxScheduleDistance = 365 * 24 * time.Hour
+)
+
+type scheduledMessageResponse struct {
+	ID             int64     `json:"id"`
+	ConversationID int64     `json:"conversation_id"`
+	SenderID       int64     `json:"sender_id"`
+	Content        string    `json:"content"`
+	MessageType    string    `json:"message_type"`
+	SendAt         time.Time `json:"send_at"`
+	Status         string    `json:"status"` // pending, sending, sent, cancelled, failed
+	MessageID      *int64    `json:"message_id,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	richPayload
+}
+
+// scheduleMessage stores a message for later delivery. It is called by
+// sendMessageHandler when send_at is in the future, after validateMessageBody.
+func scheduleMessage(w http.ResponseWriter, req sendMessageRequest) {
+	if msg := validateSendAt(*req.SendAt, req.richPayload); msg != "" {
+		httpError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if err := checkCanPost(req.ConversationID, req.SenderID); err != nil {
+		participantError(w, err)
+		return
+	}
+
+	res, err := db.Exec("INSERT INTO scheduled_messages (conversation_id, sender_id, content, message_type, payload, send_at) VALUES (?, ?, ?, ?, ?, ?)",
+		req.ConversationID, req.SenderID, req.Content, req.MessageType, req.richPayload.encode(), req.SendAt.UTC())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	sm, err := loadScheduledMessage(id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "failed to read scheduled message: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusAccepted, map[string]any{"scheduled_message": sm})
+}
+
+// validateSendAt checks a new send_at; a poll must still be open by then.
+func validateSendAt(sendAt time.Time, p richPayload) string {
+	if !sendAt.After(time.Now()) {
+		return "send_at must be in the future"
+	}
+	if sendAt.After(time.Now().Add(maxScheduleDistance)) {
+		return "send_at is too far in the future"
+	}
+	return validatePollCloses(sendAt, p)
+}
+
+func validatePollCloses(sendAt time.Time, p richPayload) string {
+	if p.Poll != nil && p.Poll.ClosesAt != nil && !p.Poll.ClosesAt.After(sendAt) {
+		return "poll.closes_at must be after send_at"
+	}
+	return ""
+}
+
+func listScheduledMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	status := q.Get("status")
+	if status == "" {
+		status = "pending"
+	}
+	query := "SELECT " + scheduledColumns + " FROM scheduled_messages WHERE sender_id = ?"
+	args := []any{userID}
+	if status != "all" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if v := q.Get("conversation_id"); v != "" {
+		convID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid conversation_id")
+			return
+		}
+		query += " AND conversation_id = ?"
+		args = append(args, convID)
+	}
+	query += " ORDER BY send_at ASC, id ASC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	items := []scheduledMessageResponse{}
+	for rows.Next() {
+		sm, err := scanScheduledMessage(rows)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		items = append(items, sm)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{"scheduled_messages": items})
+}
+
+func updateScheduledMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid scheduled message id")
+		return
+	}
+
+	var req struct {
+		Content     *string    `json:"content"`
+		MessageType *string    `json:"message_type"`
+		SendAt      *time.Time `json:"send_at"`
+
+		richPayload
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	sm, ok := ownedPendingScheduled(w, id, userID)
+	if !ok {
+		return
+	}
+	if req.MessageType != nil || req.richPayload.encode().Valid {
+		if req.MessageType != nil {
+			sm.MessageType = *req.MessageType
+		}
+		sm.richPayload = req.richPayload
+		if req.Content == nil && sm.richPayload.encode().Valid {
+			sm.Content = "" // filled in with the new fallback
+		}
+	}
+	if req.Content != nil {
+		sm.Content = *req.Content
+	}
+	if err := validateMessageBody(sm.ConversationID, &sm.MessageType, &sm.Content, &sm.richPayload); err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// send_at only has to be in the future when it changes
+	msg := validatePollCloses(sm.SendAt, sm.richPayload)
+	if req.SendAt != nil {
+		sm.SendAt = *req.SendAt
+		msg = validateSendAt(sm.SendAt, sm.richPayload)
+	}
+	if msg != "" {
+		httpError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	// status = 'pending' guards against the scheduler claiming it meanwhile
+	res, err := db.Exec(`
+		UPDATE scheduled_messages SET content = ?, message_type = ?, payload = ?, send_at = ?
+		WHERE id = ? AND status = 'pending'`, sm.Content, sm.MessageType, sm.richPayload.encode(), sm.SendAt.UTC(), id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if sm, err = loadScheduledMessage(id); err == nil && sm.Status != "pending" {
+			httpError(w, http.StatusConflict, "scheduled message is already "+sm.Status)
+			return
+		}
+	}
+
+	sm, err = loadScheduledMessage(id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "failed to read scheduled message: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"scheduled_message": sm})
+}
+
+func cancelScheduledMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid scheduled message id")
+		return
+	}
+	if _, ok := ownedPendingScheduled(w, id, userID); !ok {
+		return
+	}
+
+	res, err := db.Exec("UPDATE scheduled_messages SET status = 'cancelled' WHERE id = ? AND status = 'pending'", id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusConflict, "scheduled message is no longer pending")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{"id": id, "status": "cancelled"})
+}
+
+// ownedPendingScheduled loads a scheduled message for editing, writing the
+// error response if it does not exist, is not the caller's, or already left
+// the pending state.
+func ownedPendingScheduled(w http.ResponseWriter, id, userID int64) (scheduledMessageResponse, bool) {
+	sm, err := loadScheduledMessage(id)
+	if err == sql.ErrNoRows || (err == nil && sm.SenderID != userID) {
+		httpError(w, http.StatusNotFound, "scheduled message not found")
+		return sm, false
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return sm, false
+	}
+	if sm.Status != "pending" {
+		httpError(w, http.StatusConflict, "scheduled message is already "+sm.Status)
+		return sm, false
+	}
+	return sm, true
+}
+
+const scheduledColumns = "id, conversation_id, sender_id, content, message_type, payload, send_at, status, message_id, error, created_at"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanScheduledMessage(row rowScanner) (scheduledMessageResponse, error) {
+	var sm scheduledMessageResponse
+	var msgID sql.NullInt64
+	var payload, errText sql.NullString
+	err := row.Scan(&sm.ID, &sm.ConversationID, &sm.SenderID, &sm.Content, &sm.MessageType, &payload, &sm.SendAt,
+		&sm.Status, &msgID, &errText, &sm.CreatedAt)
+	if msgID.Valid {
+		sm.MessageID = &msgID.Int64
+	}
+	sm.Error = errText.String
+	if sm.MessageType == "poll" && payload.Valid {
+		// not posted yet, so there are no results to load
+		sm.Poll = &pollPayload{}
+		json.Unmarshal([]byte(payload.String), sm.Poll)
+	} else {
+		sm.richPayload = decodeRichPayload(0, sm.MessageType, payload)
+	}
+	return sm, err
+}
+
+func loadScheduledMessage(id int64) (scheduledMessageResponse, error) {
+	return scanScheduledMessage(db.QueryRow("SELECT "+scheduledColumns+" FROM scheduled_messages WHERE id = ?", id))
+}
+
+// runScheduler delivers due scheduled messages until the process exits.
+func runScheduler() {
+	// A crash between claiming a row and recording the result leaves it in
+	// 'sending' without a message_id. Retry them: each delivery carries the
+	// client_msg_id "scheduled:<id>", which clients cannot use (see
+	// validateClientMsgID), so one that was saved before the crash
+	// comes back as the original instead of being sent twice.
+	if _, err := db.Exec("UPDATE scheduled_messages SET status = 'pending' WHERE status = 'sending' AND message_id IS NULL"); err != nil {
+		log.Printf("Scheduler: failed to recover interrupted messages: %v", err)
+	}
+
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		deliverDueScheduled()
+	}
+}
+
+func deliverDueScheduled() {
+	rows, err := db.Query("SELECT "+scheduledColumns+" FROM scheduled_messages WHERE status = 'pending' AND send_at <= ? ORDER BY send_at ASC, id ASC LIMIT ?",
+		time.Now().UTC(), schedulerBatchSize)
+	if err != nil {
+		log.Printf("Scheduler: query failed: %v", err)
+		return
+	}
+	var due []scheduledMessageResponse
+	for rows.Next() {
+		sm, err := scanScheduledMessage(rows)
+		if err != nil {
+			log.Printf("Scheduler: scan failed: %v", err)
+			continue
+		}
+		due = append(due, sm)
+	}
+	rows.Close()
+
+	for _, sm := range due {
+		// Claim it; an edit or cancel that won the race leaves nothing to do
+		res, err := db.Exec("UPDATE scheduled_messages SET status = 'sending' WHERE id = ? AND status = 'pending'", sm.ID)
+		if err != nil {
+			log.Printf("Scheduler: failed to claim %d: %v", sm.ID, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		if err := checkCanPost(sm.ConversationID, sm.SenderID); err != nil {
+			failScheduled(sm.ID, err)
+			continue
+		}
+
+		stored, err := hub.Deliver(Message{
+			ConversationID: sm.ConversationID,
+			SenderID:       sm.SenderID,
+			Content:        sm.Content,
+			MessageType:    sm.MessageType,
+			ClientMsgID:    fmt.Sprintf("%s%d", scheduledClientMsgID, sm.ID),
+			richPayload:    sm.richPayload,
+		})
+		if err != nil {
+			failScheduled(sm.ID, err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE scheduled_messages SET status = 'sent', message_id = ? WHERE id = ?", stored.ID, sm.ID); err != nil {
+			log.Printf("Scheduler: sent %d as message %d but failed to record it: %v", sm.ID, stored.ID, err)
+		}
+	}
+}
+
+func failScheduled(id int64, cause error) {
+	log.Printf("Scheduler: scheduled message %d failed: %v", id, cause)
+	if _, err := db.Exec("UPDATE scheduled_messages SET status = 'failed', error = ? WHERE id = ?", truncateRunes(fmt.Sprint(cause), 250), id); err != nil {
+		log.Printf("Scheduler: failed to mark %d as failed: %v", id, err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ==== Message search ====
+//
+// GET /api/search/messages?q=...&limit=&before=
+//
+// q is free text plus optional filters:
+//
+//	from:alice  from:"Moses Gitau"   sender username
+//	in:29  in:"New Group"            conversation ID or name
+//	has:file  has:image  has:video   media messages (has:file matches all three)
+//	before:2025-10-02  after:2025-10-01
+//
+// Free text is matched against the FULLTEXT index on messages.plain_text, the
+// content without Markdown markers.
+// Only conversations the caller belongs to are searched; deleted messages
+// are gone from the table and can never match, and messages past their
+// disappearing-messages expiry are skipped even before the reaper runs. Results are newest first and
+// paginated with the ID cursor in next_cursor (pass it back as before=).
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+	snippetRadius         = 60 // runes of context on each side of the first hit
+)
+
+type searchResult struct {
+	Message      messageResponse      `json:"message"`
+	Conversation conversationResponse `json:"conversation"`
+	Snippet      string               `json:"snippet"` // HTML-escaped, hits wrapped in <mark>
+}
+
+type searchQuery struct {
+	Terms      []string // free-text words and phrases
+	From       string
+	In         string
+	MediaTypes []string
+	Before     *time.Time
+	After      *time.Time
+}
+
+func searchMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	sq, err := parseSearchQuery(q.Get("q"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(sq.Terms) == 0 && sq.From == "" && sq.In == "" && sq.MediaTypes == nil && sq.Before == nil && sq.After == nil {
+		httpError(w, http.StatusBadRequest, "q required")
+		return
+	}
+
+	limit := defaultSearchPageSize
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxSearchPageSize {
+			limit = maxSearchPageSize
+		}
+	}
+	var before int64
+	if v := q.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid before cursor")
+			return
+		}
+	}
+
+	query := `
+		SELECT m.id, m.conversation_id, m.seq, m.sender_id, m.content, COALESCE(m.plain_text, m.content), m.entities, m.message_type, m.payload, m.created_at,
+		       c.name, c.is_group
+		FROM messages m
+		JOIN conversations c ON c.id = m.conversation_id
+		JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = ?`
+	args := []any{userID}
+	where := []string{notExpired}
+
+	if len(sq.Terms) > 0 {
+		where = append(where, "MATCH(m.plain_text) AGAINST (? IN BOOLEAN MODE)")
+		args = append(args, booleanModeQuery(sq.Terms))
+	}
+	if sq.From != "" {
+		query += " JOIN users su ON su.id = m.sender_id"
+		where = append(where, "su.username = ?")
+		args = append(args, sq.From)
+	}
+	if sq.In != "" {
+		if id, err := strconv.ParseInt(sq.In, 10, 64); err == nil {
+			where = append(where, "c.id = ?")
+			args = append(args, id)
+		} else {
+			where = append(where, "c.name = ?")
+			args = append(args, sq.In)
+		}
+	}
+	if sq.MediaTypes != nil {
+		where = append(where, "m.message_type IN (?"+strings.Repeat(", ?", len(sq.MediaTypes)-1)+")")
+		for _, t := range sq.MediaTypes {
+			args = append(args, t)
+		}
+	}
+	if sq.Before != nil {
+		where = append(where, "m.created_at < ?")
+		args = append(args, *sq.Before)
+	}
+	if sq.After != nil {
+		where = append(where, "m.created_at >= ?")
+		args = append(args, *sq.After)
+	}
+	if before > 0 {
+		where = append(where, "m.id < ?")
+		args = append(args, before)
+	}
+	query += " WHERE " + strings.Join(where, " AND ")
+	query += " ORDER BY m.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	results := []searchResult{}
+	for rows.Next() {
+		var res searchResult
+		var name, payload, entities sql.NullString
+		m := &res.Message
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Seq, &m.SenderID, &m.Content, &m.Text, &entities, &m.MessageType, &payload, &m.CreatedAt, &name, &res.Conversation.IsGroup); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		m.richPayload = decodeRichPayload(m.ID, m.MessageType, payload)
+		m.Entities = decodeEntities(entities)
+		res.Conversation.ID = m.ConversationID
+		res.Conversation.Name = name.String
+		res.Snippet = highlightSnippet(m.Text, sq.Terms)
+		results = append(results, res)
+	}
+
+	resp := map[string]any{"results": results, "has_more": false, "next_cursor": nil}
+	if len(results) > limit {
+		results = results[:limit]
+		resp["results"] = results
+		resp["has_more"] = true
+		resp["next_cursor"] = results[limit-1].Message.ID
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// parseSearchQuery splits q into filters and free-text terms. Double quotes
+// group words into a phrase, both for terms and for filter values.
+func parseSearchQuery(q string) (searchQuery, error) {
+	var sq searchQuery
+	for _, tok := range tokenizeSearchQuery(q) {
+		key, value, ok := strings.Cut(tok, ":")
+		if !ok || value == "" {
+			sq.Terms = append(sq.Terms, tok)
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "from":
+			sq.From = strings.TrimPrefix(value, "@")
+		case "in":
+			sq.In = value
+		case "has":
+			switch strings.ToLower(value) {
+			case "file":
+				sq.MediaTypes = []string{"image", "video", "file"}
+			case "image", "video":
+				sq.MediaTypes = []string{strings.ToLower(value)}
+			default:
+				return sq, fmt.Errorf("unknown has: filter %q (use file, image or video)", value)
+			}
+		case "before", "after":
+			t, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return sq, fmt.Errorf("%s: expects a date like 2025-10-02", key)
+			}
+			if strings.ToLower(key) == "before" {
+				sq.Before = &t
+			} else {
+				sq.After = &t
+			}
+		default:
+			// Not a filter, e.g. a time like 10:30
+			sq.Terms = append(sq.Terms, tok)
+		}
+	}
+	return sq, nil
+}
+
+// tokenizeSearchQuery splits on whitespace, keeping "quoted phrases" together
+// (quotes are dropped). A quote may start mid-token, as in from:"Moses Gitau".
+func tokenizeSearchQuery(q string) []string {
+	var tokens []string
+	var cur strings.Builder
+	inQuotes := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case unicode.IsSpace(r) && !inQuotes:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// booleanModeQuery requires every term: words match as prefixes, phrases
+// match exactly. Boolean operators typed by the user are stripped.
+func booleanModeQuery(terms []string) string {
+	var parts []string
+	for _, t := range terms {
+		t = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`+-<>()~*"@`, r) {
+				return ' '
+			}
+			return r
+		}, t)
+		t = strings.Join(strings.Fields(t), " ")
+		if t == "" {
+			continue
+		}
+		if strings.Contains(t, " ") {
+			parts = append(parts, `+"`+t+`"`)
+		} else {
+			parts = append(parts, "+"+t+"*")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// highlightSnippet cuts a window around the first matching term and wraps
+// every case-insensitive occurrence of a term in <mark>. The rest of the text
+// is HTML-escaped so the snippet can be inserted as markup.
+func highlightSnippet(content string, terms []string) string {
+	// Fold rune by rune so indexes in lower and text line up
+	text := []rune(content)
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	var needles [][]rune
+	for _, t := range terms {
+		var n []rune
+		for _, r := range strings.TrimSpace(t) {
+			n = append(n, unicode.ToLower(r))
+		}
+		if len(n) > 0 {
+			needles = append(needles, n)
+		}
+	}
+
+	// marks[i] is the length of a hit starting at rune i
+	marks := make(map[int]int)
+	first := -1
+	for i := range lower {
+		for _, n := range needles {
+			if i+len(n) <= len(lower) && string(lower[i:i+len(n)]) == string(n) {
+				if len(n) > marks[i] {
+					marks[i] = len(n)
+				}
+				if first < 0 {
+					first = i
+				}
+			}
+		}
+	}
+
+	// A window of 2*snippetRadius runes, the first hit in the middle when
+	// there is enough text before it
+	start, end := 0, len(text)
+	if first > snippetRadius {
+		start = first - snippetRadius
+	}
+	if start+snippetRadius*2 < end {
+		end = start + snippetRadius*2
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		if n, ok := marks[i]; ok {
+			stop := min(i+n, end)
+			b.WriteString("<mark>" + html.EscapeString(string(text[i:stop])) + "</mark>")
+			i = stop
+			continue
+		}
+		b.WriteString(html.EscapeString(string(text[i])))
+		i++
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	day := func(s string) *time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return &d
+	}
+	tests := []struct {
+		q    string
+		want searchQuery
+	}{
+		{"lunch plans", searchQuery{Terms: []string{"lunch", "plans"}}},
+		{`"lunch plans" friday`, searchQuery{Terms: []string{"lunch plans", "friday"}}},
+		{`from:@alice in:general report`, searchQuery{From: "alice", In: "general", Terms: []string{"report"}}},
+		{`from:"Moses Gitau"`, searchQuery{From: "Moses Gitau"}},
+		{"has:file", searchQuery{MediaTypes: []string{"image", "video", "file"}}},
+		{"has:IMAGE", searchQuery{MediaTypes: []string{"image"}}},
+		{"after:2025-10-01 before:2025-10-31", searchQuery{After: day("2025-10-01"), Before: day("2025-10-31")}},
+		{"meet at 10:30", searchQuery{Terms: []string{"meet", "at", "10:30"}}},
+		{"note: x", searchQuery{Terms: []string{"note:", "x"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSearchQuery(tt.q)
+		if err != nil {
+			t.Errorf("parseSearchQuery(%q) error: %v", tt.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.q, got, tt.want)
+		}
+	}
+
+	for _, q := range []string{"has:pdf", "before:yesterday", "after:2025-13-01"} {
+		if _, err := parseSearchQuery(q); err == nil {
+			t.Errorf("parseSearchQuery(%q) succeeded, want an error", q)
+		}
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		terms   []string
+		want    string
+	}{
+		{"marks every hit", "Lunch at noon, lunch!", []string{"lunch"}, "<mark>Lunch</mark> at noon, <mark>lunch</mark>!"},
+		{"escapes html", "<b>hi</b> there", []string{"there"}, "&lt;b&gt;hi&lt;/b&gt; <mark>there</mark>"},
+		{"longest overlapping term", "report card", []string{"rep", "report"}, "<mark>report</mark> card"},
+		{"no hit", "nothing here", []string{"zzz"}, "nothing here"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightSnippet(tt.content, tt.terms); got != tt.want {
+				t.Errorf("highlightSnippet = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("window", func(t *testing.T) {
+		long := strings.Repeat("a ", 100) + "needle" + strings.Repeat(" b", 100)
+		got := highlightSnippet(long, []string{"needle"})
+		if !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") || !strings.Contains(got, "<mark>needle</mark>") {
+			t.Errorf("highlightSnippet = %q, want an elided window around the hit", got)
+		}
+		if n := len([]rune(got)); n > 2*snippetRadius+len("<mark></mark>")+2 {
+			t.Errorf("snippet is %d runes long", n)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// ==== Per-conversation sequence numbers ====
+//
+// Every message gets seq = 1, 2, 3... within its conversation, taken from
+// conversations.last_seq in the same transaction as the insert. Bumping
+// last_seq locks the conversation row, so concurrent senders queue up, and a
+// failed insert rolls the counter back with it: seq has no gaps and no ties
+// (unique key on messages (conversation_id, seq)). History paging, sync
+// cursors and unread counts all go by seq rather than created_at or id.
+
+// insertMessage stores a message with the next seq of its conversation and
+// returns its ID, seq and creation time. It also fills in msg.Text and
+// msg.Entities from the Markdown in the content.
+func insertMessage(msg *Message) (id, seq int64, createdAt time.Time, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	if id, seq, createdAt, err = insertMessageTx(tx, msg); err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	return id, seq, createdAt, tx.Commit()
+}
+
+// insertMessageTx is insertMessage inside a transaction the caller commits.
+func insertMessageTx(tx *sql.Tx, msg *Message) (id, seq int64, createdAt time.Time, err error) {
+	msg.Text, msg.Entities = parseMarkdown(msg.MessageType, msg.Content)
+	var entities sql.NullString
+	if len(msg.Entities) > 0 {
+		raw, _ := json.Marshal(msg.Entities)
+		entities = sql.NullString{String: string(raw), Valid: true}
+	}
+
+	var fwdMessageID, fwdSenderID sql.NullInt64
+	if msg.ForwardedFrom != nil {
+		fwdMessageID = sql.NullInt64{Int64: msg.ForwardedFrom.MessageID, Valid: true}
+		if msg.ForwardedFrom.SenderID != nil {
+			fwdSenderID = sql.NullInt64{Int64: *msg.ForwardedFrom.SenderID, Valid: true}
+		}
+	}
+
+	if _, err = tx.Exec("UPDATE conversations SET last_seq = last_seq + 1 WHERE id = ?", msg.ConversationID); err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	if err = tx.QueryRow("SELECT last_seq FROM conversations WHERE id = ?", msg.ConversationID).Scan(&seq); err != nil {
+		return 0, 0, time.Time{}, err
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO messages (conversation_id, seq, sender_id, content, plain_text, entities, message_type, payload, forwarded_from_message_id, forwarded_from_user_id, client_msg_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		msg.ConversationID, seq, msg.SenderID, msg.Content, msg.Text, entities, msg.MessageType, msg.richPayload.encode(), fwdMessageID, fwdSenderID,
+		sql.NullString{String: msg.ClientMsgID, Valid: msg.ClientMsgID != ""},
+	)
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	id, _ = res.LastInsertId()
+	if msg.Poll != nil {
+		if err = insertPoll(tx, id, msg.ConversationID, msg.Poll); err != nil {
+			return 0, 0, time.Time{}, err
+		}
+	}
+	if err = tx.QueryRow("SELECT created_at FROM messages WHERE id = ?", id).Scan(&createdAt); err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	return id, seq, createdAt, nil
+}
+
+// messageSeq returns the seq of a message in a conversation, or sql.ErrNoRows.
+func messageSeq(convID, msgID int64) (int64, error) {
+	var seq int64
+	err := db.QueryRow("SELECT seq FROM messages WHERE id = ? AND conversation_id = ?", msgID, convID).Scan(&seq)
+	return seq, err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ==== Per-user conversation settings ====
+//
+// Each participant keeps their own flags on conversation_participants:
+//
+//	muted_until    no mention notifications until then; messages still arrive
+//	archived       left out of the default conversation list
+//	pinned_order   pinned to the top of the list, lowest first
+//	marked_unread  listed as unread until the conversation is read again
+//
+// PATCH /api/conversations/{id}/settings changes any of them:
+//
+//	{"muted_until": "2025-10-03T08:00:00Z" | "forever" | null,
+//	 "archived": true, "pinned": true, "pin_order": 2, "marked_unread": true}
+//
+// An archived conversation comes back to the list when a new message arrives,
+// unless it is muted; system messages do not bring it back.
+
+const maxPinnedConversations = 5
+
+// participantSettings is embedded in conversationResponse for the caller.
+type participantSettings struct {
+	MutedUntil   *time.Time `json:"muted_until"`
+	Archived     bool       `json:"archived"`
+	Pinned       bool       `json:"pinned"`
+	PinOrder     *int64     `json:"pin_order"`
+	MarkedUnread bool       `json:"marked_unread"`
+}
+
+// PATCH /api/conversations/{id}/settings
+func updateConversationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, convID, ok := conversationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		MutedUntil   json.RawMessage `json:"muted_until"`
+		Archived     *bool           `json:"archived"`
+		Pinned       *bool           `json:"pinned"`
+		PinOrder     *int64          `json:"pin_order"`
+		MarkedUnread *bool           `json:"marked_unread"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	// the user's rows are locked so concurrent pins cannot pass the limit together
+	tx, err := db.Begin()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT conversation_id FROM conversation_participants WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	current, err := loadParticipantSettings(convID, userID)
+	if err != nil {
+		participantError(w, err)
+		return
+	}
+
+	var sets []string
+	var args []any
+
+	if len(req.MutedUntil) > 0 {
+		var until string
+		switch {
+		case bytes.Equal(req.MutedUntil, []byte("null")):
+			sets = append(sets, "muted_until = NULL")
+		case json.Unmarshal(req.MutedUntil, &until) != nil:
+			httpError(w, http.StatusBadRequest, `muted_until must be a time, "forever" or null`)
+			return
+		case until == "forever":
+			sets, args = append(sets, "muted_until = ?"), append(args, mutedForever)
+		default:
+			t, err := time.Parse(time.RFC3339, until)
+			if err != nil || !t.After(time.Now()) {
+				httpError(w, http.StatusBadRequest, `muted_until must be a future RFC 3339 time, "forever" or null`)
+				return
+			}
+			// relative to the database clock, which muted_until is compared against
+			sets, args = append(sets, "muted_until = NOW() + INTERVAL ? SECOND"), append(args, int64(time.Until(t).Seconds()))
+		}
+	}
+
+	if req.Archived != nil {
+		sets, args = append(sets, "archived = ?"), append(args, *req.Archived)
+	}
+
+	pinned := current.Pinned
+	if req.Pinned != nil {
+		pinned = *req.Pinned
+	}
+	switch {
+	case req.Pinned != nil && !*req.Pinned:
+		sets = append(sets, "pinned_order = NULL")
+	case req.PinOrder != nil && !pinned:
+		httpError(w, http.StatusBadRequest, "pin_order needs the conversation to be pinned")
+		return
+	case pinned && !current.Pinned:
+		var count int
+		var next int64
+		err := tx.QueryRow("SELECT COUNT(*), COALESCE(MAX(pinned_order), 0) + 1 FROM conversation_participants WHERE user_id = ? AND pinned_order IS NOT NULL", userID).
+			Scan(&count, &next)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+		if count >= maxPinnedConversations {
+			httpError(w, http.StatusConflict, fmt.Sprintf("you can pin at most %d conversations", maxPinnedConversations))
+			return
+		}
+		if req.PinOrder != nil {
+			next = *req.PinOrder
+		}
+		sets, args = append(sets, "pinned_order = ?"), append(args, next)
+	case req.PinOrder != nil:
+		sets, args = append(sets, "pinned_order = ?"), append(args, *req.PinOrder)
+	}
+
+	if req.MarkedUnread != nil {
+		sets, args = append(sets, "marked_unread = ?"), append(args, *req.MarkedUnread)
+	}
+
+	if len(sets) > 0 {
+		args = append(args, convID, userID)
+		query := "UPDATE conversation_participants SET " + strings.Join(sets, ", ") + " WHERE conversation_id = ? AND user_id = ?"
+		if _, err := tx.Exec(query, args...); err != nil {
+			httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	settings, err := loadParticipantSettings(convID, userID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"conversation_id": convID, "settings": settings})
+}
+
+// loadParticipantSettings reads the caller's flags; an expired mute reads as none.
+func loadParticipantSettings(convID, userID int64) (participantSettings, error) {
+	var s participantSettings
+	err := db.QueryRow(`
+		SELECT IF(muted_until > NOW(), muted_until, NULL), archived, pinned_order, marked_unread
+		FROM conversation_participants WHERE conversation_id = ? AND user_id = ?`, convID, userID).
+		Scan(&s.MutedUntil, &s.Archived, &s.PinOrder, &s.MarkedUnread)
+	if err == sql.ErrNoRows {
+		return s, errNotParticipant
+	}
+	s.Pinned = s.PinOrder != nil
+	return s, err
+}
+
+// unarchiveOnMessage brings an archived conversation back to the list of the
+// members who have not muted it. Call it for every new non-system message.
+func unarchiveOnMessage(convID int64) error {
+	_, err := db.Exec(`
+		UPDATE conversation_participants SET archived = 0
+		WHERE conversation_id = ? AND archived = 1 AND (muted_until IS NULL OR muted_until <= NOW())`, convID)
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ==== Starred messages ====
+//
+// Stars are private to each user and point at the message row, so the list
+// always shows the current content and a deleted message drops out of it
+// (starred_messages cascades on messages). Stars in conversations the user
+// has since left are hidden.
+
+type starredResponse struct {
+	ID           int64                `json:"id"`
+	Message      messageResponse      `json:"message"`
+	Conversation conversationResponse `json:"conversation"`
+	Note         string               `json:"note,omitempty"`
+	StarredAt    time.Time            `json:"starred_at"`
+}
+
+const maxStarNoteLength = 500
+
+// PUT /api/messages/{id}/star {"note": "..."}
+// Starring an already starred message replaces its note.
+func starMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	msgID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	var req struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+	if len([]rune(req.Note)) > maxStarNoteLength {
+		httpError(w, http.StatusBadRequest, "note is too long")
+		return
+	}
+
+	convID, err := messageConversationID(msgID)
+	if err == sql.ErrNoRows {
+		httpError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if _, _, err := participantRole(convID, userID); err != nil {
+		participantError(w, err)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO starred_messages (user_id, message_id, note) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE note = VALUES(note)`,
+		userID, msgID, sql.NullString{String: req.Note, Valid: req.Note != ""})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{"message_id": msgID, "starred": true, "note": req.Note})
+}
+
+// DELETE /api/messages/{id}/star
+func unstarMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	msgID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM starred_messages WHERE user_id = ? AND message_id = ?", userID, msgID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpError(w, http.StatusNotFound, "message is not starred")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{"message_id": msgID, "starred": false})
+}
+
+// GET /api/users/me/starred?limit=&before=
+//
+// Most recently starred first. next_cursor is a star ID to pass back as before=.
+func listStarredHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultMessagePageSize
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxMessagePageSize {
+			limit = maxMessagePageSize
+		}
+	}
+
+	query := `
+		SELECT s.id, s.note, s.created_at,
+		       m.id, m.conversation_id, m.seq, m.sender_id, m.content, COALESCE(m.plain_text, m.content), m.entities, m.message_type, m.payload, m.mentions, m.created_at,
+		       c.name, c.is_group
+		FROM starred_messages s
+		JOIN messages m ON m.id = s.message_id
+		JOIN conversations c ON c.id = m.conversation_id
+		JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id AND cp.user_id = s.user_id
+		WHERE s.user_id = ? AND ` + notExpired
+	args := []any{userID}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid before cursor")
+			return
+		}
+		query += " AND s.id < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY s.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "db error: "+err.Error())
+		return
+	}
+	defer rows.Close()
+
+	items := []starredResponse{}
+	for rows.Next() {
+		var it starredResponse
+		var note, mentions, payload, entities, name sql.NullString
+		m := &it.Message
+		if err := rows.Scan(&it.ID, &note, &it.StarredAt,
+			&m.ID, &m.ConversationID, &m.Seq, &m.SenderID, &m.Content, &m.Text, &entities, &m.MessageType, &payload, &mentions, &m.CreatedAt,
+			&name, &it.Conversation.IsGroup); err != nil {
+			httpError(w, http.StatusInternalServerError, "scan error: "+err.Error())
+			return
+		}
+		m.richPayload = decodeRichPayload(m.ID, m.MessageType, payload)
+		m.Entities = decodeEntities(entities)
+		if mentions.Valid {
+			json.Unmarshal([]byte(mentions.String), &m.Mentions)
+		}
+		it.Note = note.String
+		it.Conversation.ID = m.ConversationID
+		it.Conversation.Name = name.String
+		items = append(items, it)
+	}
+
+	resp := map[string]any{"starred": items, "has_more": false, "next_cursor": nil}
+	if len(items) > limit {
+		items = items[:limit]
+		resp["starred"] = items
+		resp["has_more"] = true
+		resp["next_cursor"] = items[limit-1].ID
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
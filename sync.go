@@ -0,0 +1,220 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// ==== Offline catch-up ====
+//
+// After reconnecting, a client sends the last message ID it saw live
+//
+//	{"type":"sync","last_message_id":N}
+//
+// and/or per-conversation seq cursors ({"cursors":{"12":340}}; conversations
+// missing from the map fall back to last_message_id). The server replays what
+// happened in the meantime: message_expired for messages the client may still
+// show but that were deleted, the missed messages oldest first, and the other
+// participants' read pointers as read_receipt frames. sync_complete ends the
+// backlog with the new seq cursor of every conversation.
+//
+// While the backlog is written the Hub holds back live frames for the client
+// and flushes them afterwards, skipping messages the backlog already carried,
+// so nothing is lost or delivered twice. Messages cannot be edited, so there
+// are no edits to replay.
+
+const (
+	// syncMaxPerConversation caps the replay; past it the client pages on
+	// with GET /api/messages?after=.
+	syncMaxPerConversation = 200
+	// tombstoneRetention is how long deleted_messages remembers a deletion,
+	// i.e. how long a client can stay away and still be told about it.
+	tombstoneRetention = 7 * 24 * time.Hour
+)
+
+type syncFrame struct {
+	LastMessageID int64           `json:"last_message_id"`
+	Cursors       map[int64]int64 `json:"cursors"` // conversation ID -> last seen seq
+}
+
+// ReadReceiptEvent carries a participant's read pointer.
+type ReadReceiptEvent struct {
+	Type              string `json:"type"` // "read_receipt"
+	ConversationID    int64  `json:"conversation_id"`
+	UserID            int64  `json:"user_id"`
+	LastReadMessageID int64  `json:"last_read_message_id"`
+	LastReadSeq       int64  `json:"last_read_seq"`
+}
+
+type syncedConversation struct {
+	ConversationID int64 `json:"conversation_id"`
+	LastSeq        int64 `json:"last_seq"` // cursor for the next sync
+	HasMore        bool  `json:"has_more"` // capped; fetch the rest with after=
+}
+
+// SyncCompleteEvent ends the backlog; live delivery resumes after it.
+type SyncCompleteEvent struct {
+	Type          string               `json:"type"` // "sync_complete"
+	Conversations []syncedConversation `json:"conversations"`
+}
+
+// syncDone hands a client back to live delivery. lastSeqs holds the newest
+// seq of each conversation in the backlog.
+type syncDone struct {
+	client   *Client
+	lastSeqs map[int64]int64
+}
+
+// syncClient writes the backlog for req straight to the client's connection.
+// That is safe because the Hub writes nothing to a syncing client.
+func syncClient(client *Client, req syncFrame) {
+	hub.SyncStart <- client
+	lastSeqs := map[int64]int64{}
+	defer func() { hub.SyncDone <- syncDone{client: client, lastSeqs: lastSeqs} }()
+
+	frames, err := syncBacklog(client.ID, req, lastSeqs)
+	if err != nil {
+		log.Printf("Sync failed for user %d: %v", client.ID, err)
+		return
+	}
+	for _, frame := range frames {
+		if err := client.Conn.WriteJSON(frame); err != nil {
+			log.Printf("Error sending sync backlog to user %d: %v", client.ID, err)
+			return
+		}
+	}
+}
+
+func syncBacklog(userID int64, req syncFrame, lastSeqs map[int64]int64) ([]any, error) {
+	rows, err := db.Query("SELECT conversation_id FROM conversation_participants WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	var convIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		convIDs = append(convIDs, id)
+	}
+	rows.Close()
+
+	var deletions, receipts []any
+	var messages []messageResponse
+	complete := SyncCompleteEvent{Type: "sync_complete", Conversations: []syncedConversation{}}
+
+	for _, convID := range convIDs {
+		cursor, ok := req.Cursors[convID]
+		if !ok && req.LastMessageID > 0 {
+			// message IDs grow across conversations, seq does not
+			err := db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM messages WHERE conversation_id = ? AND id <= ?",
+				convID, req.LastMessageID).Scan(&cursor)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if cursor > 0 {
+			deleted, err := deletedMessageIDs(convID, cursor)
+			if err != nil {
+				return nil, err
+			}
+			if len(deleted) > 0 {
+				deletions = append(deletions, MessageExpiredEvent{Type: "message_expired", ConversationID: convID, MessageIDs: deleted})
+			}
+		}
+
+		page, err := messagesAfter(convID, userID, cursor, syncMaxPerConversation)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, page.Messages...)
+		last := cursor
+		if n := len(page.Messages); n > 0 {
+			last = page.Messages[n-1].Seq
+		}
+		lastSeqs[convID] = last
+		complete.Conversations = append(complete.Conversations, syncedConversation{
+			ConversationID: convID,
+			LastSeq:        last,
+			HasMore:        page.HasMore,
+		})
+
+		r, err := readReceipts(convID, userID)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, r...)
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	frames := deletions
+	for _, m := range messages {
+		frames = append(frames, m)
+	}
+	frames = append(frames, receipts...)
+	return append(frames, complete), nil
+}
+
+// deletedMessageIDs returns the remembered deletions in a conversation up to
+// the client's cursor, i.e. of messages it may have on screen.
+func deletedMessageIDs(convID, upToSeq int64) ([]int64, error) {
+	rows, err := db.Query("SELECT message_id FROM deleted_messages WHERE conversation_id = ? AND seq <= ? ORDER BY seq", convID, upToSeq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// readReceipts returns the read pointers of the other participants, except
+// those with an open message request (see contacts.go).
+func readReceipts(convID, userID int64) ([]any, error) {
+	rows, err := db.Query(`
+		SELECT user_id, COALESCE(last_read_message_id, 0), last_read_seq FROM conversation_participants
+		WHERE conversation_id = ? AND user_id <> ? AND last_read_seq > 0 AND message_request IS NULL`, convID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var receipts []any
+	for rows.Next() {
+		ev := ReadReceiptEvent{Type: "read_receipt", ConversationID: convID}
+		if err := rows.Scan(&ev.UserID, &ev.LastReadMessageID, &ev.LastReadSeq); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, ev)
+	}
+	return receipts, rows.Err()
+}
+
+// finishSync flushes the frames held back during a sync. Only call it from
+// the Run goroutine.
+func (h *Hub) finishSync(done syncDone) {
+	c := done.client
+	held := c.held
+	c.syncing, c.held = false, nil
+	if h.Clients[c.ID] != c {
+		return // disconnected or replaced by a newer connection meanwhile
+	}
+	for _, payload := range held {
+		if msg, ok := payload.(Message); ok && msg.Seq <= done.lastSeqs[msg.ConversationID] {
+			continue // already part of the backlog
+		}
+		if !h.write(c, payload) {
+			return
+		}
+	}
+}
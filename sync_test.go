@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB connects db to the database named by CHAT_TEST_DSN, which must
+// hold the chat_app.sql schema. Tests that need it are skipped without one.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("CHAT_TEST_DSN")
+	if dsn == "" {
+		t.Skip("CHAT_TEST_DSN not set")
+	}
+	conn, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := conn.Ping(); err != nil {
+		t.Fatalf("ping db: %v", err)
+	}
+	prev := db
+	db = conn
+	t.Cleanup(func() {
+		db = prev
+		conn.Close()
+	})
+}
+
+// createTestUser inserts a user and removes it, with everything it owns,
+// when the test ends.
+func createTestUser(t *testing.T, name string) int64 {
+	t.Helper()
+	username := fmt.Sprintf("%s_%d", name, time.Now().UnixNano())
+	res, err := db.Exec("INSERT INTO users (username, password_hash) VALUES (?, '')", username)
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = ?", id) })
+	return id
+}
+
+func TestSyncAfterJoin(t *testing.T) {
+	openTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	carol := createTestUser(t, "carol")
+
+	res, err := db.Exec("INSERT INTO conversations (name, is_group) VALUES ('sync test', 1)")
+	if err != nil {
+		t.Fatalf("insert conversation: %v", err)
+	}
+	convID, _ := res.LastInsertId()
+	t.Cleanup(func() { db.Exec("DELETE FROM conversations WHERE id = ?", convID) })
+	for _, uid := range []int64{alice, bob} {
+		if _, err := addParticipant(convID, uid); err != nil {
+			t.Fatalf("add participant %d: %v", uid, err)
+		}
+	}
+
+	msg := Message{ConversationID: convID, SenderID: alice, Content: "hello", MessageType: "text"}
+	msgID, _, _, err := insertMessage(&msg)
+	if err != nil {
+		t.Fatalf("insert message: %v", err)
+	}
+
+	// carol joins once there is history
+	if added, err := addParticipant(convID, carol); err != nil || !added {
+		t.Fatalf("add carol: added=%v err=%v", added, err)
+	}
+
+	// a read pointer left NULL must not break anyone's sync
+	if _, err := db.Exec("UPDATE conversation_participants SET last_read_message_id = NULL, last_read_seq = 1 WHERE conversation_id = ? AND user_id = ?", convID, bob); err != nil {
+		t.Fatalf("reset bob's pointer: %v", err)
+	}
+
+	frames, err := syncBacklog(alice, syncFrame{Cursors: map[int64]int64{convID: 0}}, map[int64]int64{})
+	if err != nil {
+		t.Fatalf("syncBacklog: %v", err)
+	}
+
+	receipts := map[int64]ReadReceiptEvent{}
+	for _, f := range frames {
+		if ev, ok := f.(ReadReceiptEvent); ok && ev.ConversationID == convID {
+			receipts[ev.UserID] = ev
+		}
+	}
+	if got := receipts[carol]; got.LastReadMessageID != msgID || got.LastReadSeq != 1 {
+		t.Errorf("carol's receipt = %+v, want message %d at seq 1", got, msgID)
+	}
+	if got, ok := receipts[bob]; !ok || got.LastReadMessageID != 0 {
+		t.Errorf("bob's receipt = %+v (present %v), want message 0", got, ok)
+	}
+}
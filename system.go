@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ==== System messages ====
+//
+// Conversation events are recorded in the timeline as messages of type
+// "system" carrying what happened in a structured "system" object:
+//
+//	{"event": "member_removed", "actor_id": 1, "user_ids": [6]}
+//
+// Clients render and localize them from the event and the IDs; content holds
+// an English rendering for search and older clients. Only the server writes
+// system messages. They are not counted as unread, never mention anyone and
+// never expire.
+
+// system events, also used as the change of conversation_updated
+const (
+	systemGroupCreated       = "group_created"
+	systemMembersAdded       = "members_added"
+	systemMemberRemoved      = "member_removed"
+	systemMemberLeft         = "member_left"
+	systemOwnerChanged       = "owner_changed"
+	systemRenamed            = "renamed"
+	systemDescriptionChanged = "description_changed"
+	systemTopicChanged       = "topic_changed"
+	systemMessagePinned      = "message_pinned"
+	systemMessageUnpinned    = "message_unpinned"
+	systemTTLChanged         = "ttl_changed"
+	systemMemberJoined       = "member_joined"
+	systemMadePublic         = "made_public"
+	systemMadePrivate        = "made_private"
+	systemAdminsOnlyPosting  = "admins_only_posting"
+	systemEveryoneCanPost    = "everyone_can_post"
+)
+
+// systemEvent is the payload of a system message. Which fields are set
+// depends on Event.
+type systemEvent struct {
+	Event   string  `json:"event"`
+	ActorID int64   `json:"actor_id"`
+	UserIDs []int64 `json:"user_ids,omitempty"` // members added or removed, the new owner
+
+	Name        string `json:"name,omitempty"`        // group_created, renamed
+	Description string `json:"description,omitempty"` // description_changed; empty when removed
+	Topic       string `json:"topic,omitempty"`       // topic_changed; empty when cleared
+
+	MessageID int64  `json:"message_id,omitempty"` // message_pinned, message_unpinned
+	Preview   string `json:"preview,omitempty"`    // message_pinned
+
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"` // ttl_changed; 0 when turned off
+	TTLMode    string `json:"ttl_mode,omitempty"`
+}
+
+// postSystemMessage records a conversation event in the timeline. It goes
+// through the Hub like any other message so every participant gets it live.
+func postSystemMessage(convID int64, ev systemEvent) {
+	hub.Broadcast <- newSystemMessage(convID, ev)
+}
+
+// newSystemMessage is the unsaved system message recording ev.
+func newSystemMessage(convID int64, ev systemEvent) Message {
+	return Message{
+		ConversationID: convID,
+		SenderID:       ev.ActorID,
+		Content:        ev.render(),
+		MessageType:    "system",
+		richPayload:    richPayload{System: &ev},
+	}
+}
+
+// render is the English content of the system message.
+func (ev systemEvent) render() string {
+	actor := usernameByID(ev.ActorID)
+	users := make([]string, len(ev.UserIDs))
+	for i, uid := range ev.UserIDs {
+		users[i] = usernameByID(uid)
+	}
+
+	switch ev.Event {
+	case systemGroupCreated:
+		return fmt.Sprintf("%s created the group %q", actor, ev.Name)
+	case systemMembersAdded:
+		return actor + " added " + strings.Join(users, ", ")
+	case systemMemberRemoved:
+		return actor + " removed " + strings.Join(users, ", ")
+	case systemMemberLeft:
+		return actor + " left"
+	case systemMemberJoined:
+		return actor + " joined"
+	case systemOwnerChanged:
+		return strings.Join(users, ", ") + " is now the group owner"
+	case systemRenamed:
+		return fmt.Sprintf("%s renamed the group to %q", actor, ev.Name)
+	case systemDescriptionChanged:
+		if ev.Description == "" {
+			return actor + " removed the group description"
+		}
+		return actor + " changed the group description"
+	case systemTopicChanged:
+		if ev.Topic == "" {
+			return actor + " cleared the topic"
+		}
+		return fmt.Sprintf("%s changed the topic to %q", actor, ev.Topic)
+	case systemMessagePinned:
+		return fmt.Sprintf("%s pinned a message: %q", actor, ev.Preview)
+	case systemMessageUnpinned:
+		return actor + " unpinned a message"
+	case systemMadePublic:
+		return actor + " made the group a public channel"
+	case systemMadePrivate:
+		return actor + " made the channel private"
+	case systemAdminsOnlyPosting:
+		return actor + " made this an announcement channel: only admins can post"
+	case systemEveryoneCanPost:
+		return actor + " let everyone post again"
+	case systemTTLChanged:
+		if ev.TTLSeconds == 0 {
+			return actor + " turned off disappearing messages"
+		}
+		when := "sending"
+		if ev.TTLMode == "read" {
+			when = "reading"
+		}
+		return fmt.Sprintf("%s set messages to disappear %s after %s", actor, humanDuration(time.Duration(ev.TTLSeconds)*time.Second), when)
+	}
+	return actor + " updated the conversation"
+}
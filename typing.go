@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ==== Typing indicators ====
+//
+// Clients send {"type":"typing_start","conversation_id":N} while the user is
+// typing and {"type":"typing_stop",...} when they stop. The server keeps the
+// state in memory only, fans it out to the other participants and expires it
+// on its own if the stop frame never arrives (tab closed, network dropped...).
+
+const (
+	// typingTimeout is how long a typing_start stays valid without a refresh.
+	typingTimeout = 6 * time.Second
+	// typingThrottle is the minimum gap between two fanned-out typing_start
+	// frames for the same user and conversation. Repeats inside the window
+	// only extend the timeout.
+	typingThrottle = 2 * time.Second
+)
+
+// TypingEvent is pushed to the other participants of a conversation.
+type TypingEvent struct {
+	Type           string `json:"type"` // "typing_start" or "typing_stop"
+	ConversationID int64  `json:"conversation_id"`
+	UserID         int64  `json:"user_id"`
+}
+
+type typingKey struct {
+	ConversationID int64
+	UserID         int64
+}
+
+type typingState struct {
+	timer      *time.Timer
+	lastSent   time.Time
+	recipients []int64
+}
+
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+var typing = typingTracker{active: make(map[typingKey]*typingState)}
+
+// Start marks userID as typing in convID. The first call (and any call after
+// the throttle window) notifies the other participants.
+func (t *typingTracker) Start(convID, userID int64) {
+	key := typingKey{ConversationID: convID, UserID: userID}
+
+	t.mu.Lock()
+	if st, ok := t.active[key]; ok {
+		st.timer.Reset(typingTimeout)
+		if time.Since(st.lastSent) < typingThrottle {
+			t.mu.Unlock()
+			return
+		}
+		st.lastSent = time.Now()
+		recipients := st.recipients
+		t.mu.Unlock()
+		sendTyping("typing_start", key, recipients)
+		return
+	}
+	t.mu.Unlock()
+
+	// New typing state: make sure the user actually belongs to the conversation
+	recipients, err := typingRecipients(convID, userID)
+	if err != nil {
+		log.Printf("Ignoring typing_start from user %d in conversation %d: %v", userID, convID, err)
+		return
+	}
+
+	t.mu.Lock()
+	if _, ok := t.active[key]; ok {
+		// Another frame got there first
+		t.mu.Unlock()
+		return
+	}
+	st := &typingState{lastSent: time.Now(), recipients: recipients}
+	st.timer = time.AfterFunc(typingTimeout, func() { t.expire(key, st) })
+	t.active[key] = st
+	t.mu.Unlock()
+
+	sendTyping("typing_start", key, recipients)
+}
+
+// Stop clears the typing state and notifies the other participants.
+// It is a no-op if the user was not typing.
+func (t *typingTracker) Stop(convID, userID int64) {
+	key := typingKey{ConversationID: convID, UserID: userID}
+
+	t.mu.Lock()
+	st, ok := t.active[key]
+	if ok {
+		st.timer.Stop()
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+
+	if ok {
+		sendTyping("typing_stop", key, st.recipients)
+	}
+}
+
+// StopAll clears every conversation the user was typing in, e.g. on disconnect.
+func (t *typingTracker) StopAll(userID int64) {
+	t.mu.Lock()
+	var stopped []typingKey
+	var recipients [][]int64
+	for key, st := range t.active {
+		if key.UserID == userID {
+			st.timer.Stop()
+			delete(t.active, key)
+			stopped = append(stopped, key)
+			recipients = append(recipients, st.recipients)
+		}
+	}
+	t.mu.Unlock()
+
+	for i, key := range stopped {
+		sendTyping("typing_stop", key, recipients[i])
+	}
+}
+
+// expire runs when no refresh or stop arrived within typingTimeout.
+func (t *typingTracker) expire(key typingKey, st *typingState) {
+	t.mu.Lock()
+	if t.active[key] != st {
+		// Already stopped or replaced by a newer state
+		t.mu.Unlock()
+		return
+	}
+	delete(t.active, key)
+	t.mu.Unlock()
+
+	sendTyping("typing_stop", key, st.recipients)
+}
+
+// typingRecipients returns everyone in the conversation except the typist,
+// or an error if the typist is not a participant.
+func typingRecipients(convID, userID int64) ([]int64, error) {
+	participantIDs, err := conversationParticipantIDs(convID)
+	if err != nil {
+		return nil, err
+	}
+
+	member := false
+	var others []int64
+	for _, uid := range participantIDs {
+		if uid == userID {
+			member = true
+			continue
+		}
+		others = append(others, uid)
+	}
+	if !member {
+		return nil, errNotParticipant
+	}
+	// a message request does not show its sender that the recipient is typing
+	if hidden, err := hasMessageRequest(convID, userID); err != nil || hidden {
+		return nil, err
+	}
+	return others, nil
+}
+
+func sendTyping(eventType string, key typingKey, recipients []int64) {
+	hub.Events <- Event{
+		RecipientIDs: recipients,
+		Payload: TypingEvent{
+			Type:           eventType,
+			ConversationID: key.ConversationID,
+			UserID:         key.UserID,
+		},
+	}
+}